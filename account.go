@@ -2,6 +2,8 @@ package main
 
 import (
 	"github.com/jameskeane/bcrypt"
+	"regexp"
+	"sync"
 )
 
 type Account struct {
@@ -9,17 +11,35 @@ type Account struct {
 	Name         string
 	DisplayName  string
 	PasswordHash string
+	AuthorId     int64
 }
 
+// owner is the site owner, the oldest account, whose stream is at the root
+// of the site.
 var owner *Account
 
+// accountCache holds the accounts we've loaded by id, since every post
+// refers to one.
+var accountCache = struct {
+	sync.Mutex
+	byId map[int64]*Account
+}{byId: make(map[int64]*Account)}
+
+// accountNameRE is what account names can be, since they're in the paths of
+// accounts' streams.
+var accountNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+func IsValidAccountName(name string) bool {
+	return accountNameRE.MatchString(name)
+}
+
 func NewAccount() *Account {
-	return &Account{0, "", "", ""}
+	return &Account{0, "", "", "", 0}
 }
 
 func AccountByName(name string) (*Account, error) {
 	accounts, err := db.Select(Account{},
-		"SELECT id, passwordHash, displayName FROM account WHERE name = $1 LIMIT 1",
+		"SELECT id, name, passwordHash, displayName, authorId FROM account WHERE name = $1 LIMIT 1",
 		name)
 	if err != nil {
 		return nil, err
@@ -30,9 +50,34 @@ func AccountByName(name string) (*Account, error) {
 	return nil, nil
 }
 
+func AccountById(id int64) (*Account, error) {
+	accountCache.Lock()
+	account, ok := accountCache.byId[id]
+	accountCache.Unlock()
+	if ok {
+		return account, nil
+	}
+
+	accounts, err := db.Select(Account{},
+		"SELECT id, name, passwordHash, displayName, authorId FROM account WHERE id = $1",
+		id)
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, nil
+	}
+
+	account = accounts[0].(*Account)
+	accountCache.Lock()
+	accountCache.byId[id] = account
+	accountCache.Unlock()
+	return account, nil
+}
+
 func LoadAccountForOwner() error {
 	accounts, err := db.Select(Account{},
-		"SELECT id, name, passwordHash, displayName FROM account ORDER BY id DESC LIMIT 1")
+		"SELECT id, name, passwordHash, displayName, authorId FROM account ORDER BY id ASC LIMIT 1")
 	if err != nil {
 		return err
 	}
@@ -46,6 +91,23 @@ func AccountForOwner() *Account {
 	return owner
 }
 
+func (account *Account) IsOwner() bool {
+	return owner != nil && account.Id == owner.Id
+}
+
+// Path returns the path of the account's stream, relative to the root of the
+// site. The owner's stream is the site itself.
+func (account *Account) Path() string {
+	if account.IsOwner() {
+		return ""
+	}
+	return "/~" + account.Name
+}
+
+func (account *Account) StreamUrl(baseurl string) string {
+	return baseurl + account.Path()
+}
+
 func (account *Account) HasPassword(pass string) bool {
 	return bcrypt.Match(pass, account.PasswordHash)
 }
@@ -63,5 +125,16 @@ func (account *Account) Save() error {
 		return db.Insert(account)
 	}
 	_, err := db.Update(account)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// Load it afresh next time, so a changed name or password takes effect.
+	accountCache.Lock()
+	delete(accountCache.byId, account.Id)
+	accountCache.Unlock()
+	if account.IsOwner() {
+		owner = account
+	}
+	return nil
 }
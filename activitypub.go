@@ -0,0 +1,734 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	ACTOR_KEY_BITS        = 2048
+	MAX_ACTIVITY_SIZE     = 1 << 20
+	SIGNATURE_DATE_WINDOW = 12 * time.Hour
+)
+
+// SIGNATURE_REQUIRED_HEADERS are the headers a signature on an incoming
+// activity must cover: where it was sent, when, and what it says.
+var SIGNATURE_REQUIRED_HEADERS = []string{"(request-target)", "host", "date", "digest"}
+
+type ActorKey struct {
+	Id         int64
+	AccountId  int64
+	PrivateKey string
+	Created    time.Time
+}
+
+func (k *ActorKey) Save() error {
+	if k.Id == 0 {
+		return db.Insert(k)
+	}
+	_, err := db.Update(k)
+	return err
+}
+
+// PrivateKeyForAccount returns the key with which to sign the account's
+// activities, making one if the account doesn't have one yet.
+func PrivateKeyForAccount(account *Account) (*rsa.PrivateKey, error) {
+	rows, err := db.Select(ActorKey{},
+		"SELECT id, accountId, privateKey, created FROM actorkey WHERE accountId = $1",
+		account.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) > 0 {
+		actorKey := rows[0].(*ActorKey)
+		block, _ := pem.Decode([]byte(actorKey.PrivateKey))
+		if block == nil {
+			return nil, fmt.Errorf("Could not decode private key PEM for account %d", account.Id)
+		}
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	logr.Debugln("Generating new actor key for account", account.Id)
+	key, err := rsa.GenerateKey(rand.Reader, ACTOR_KEY_BITS)
+	if err != nil {
+		return nil, err
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	actorKey := &ActorKey{0, account.Id, string(keyPem), time.Now().UTC()}
+	err = actorKey.Save()
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+type Follower struct {
+	Id        int64
+	AccountId int64
+	Actor     string
+	Inbox     string
+	Created   time.Time
+}
+
+func (f *Follower) Save() error {
+	if f.Id == 0 {
+		return db.Insert(f)
+	}
+	_, err := db.Update(f)
+	return err
+}
+
+func FollowersForAccount(accountId int64) ([]*Follower, error) {
+	rows, err := db.Select(Follower{},
+		"SELECT id, accountId, actor, inbox, created FROM follower WHERE accountId = $1 ORDER BY created ASC",
+		accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	followers := make([]*Follower, len(rows))
+	for i, row := range rows {
+		followers[i] = row.(*Follower)
+	}
+	return followers, nil
+}
+
+func FollowerByActor(accountId int64, actor string) (*Follower, error) {
+	rows, err := db.Select(Follower{},
+		"SELECT id, accountId, actor, inbox, created FROM follower WHERE accountId = $1 AND actor = $2",
+		accountId, actor)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].(*Follower), nil
+}
+
+func DeleteFollower(accountId int64, actor string) error {
+	_, err := db.Exec("DELETE FROM follower WHERE accountId = $1 AND actor = $2",
+		accountId, actor)
+	return err
+}
+
+func actorUrl(baseurl string, account *Account) string {
+	return account.StreamUrl(baseurl) + "/actor"
+}
+
+func actorKeyId(baseurl string, account *Account) string {
+	return actorUrl(baseurl, account) + "#main-key"
+}
+
+// idOf returns the id of an activity property, which may be a bare id or an
+// embedded object with one.
+func idOf(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		if id, ok := v["id"].(string); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// accountForActivity returns the account whose actor post's activities are
+// by, or the owner if it can't be found.
+func accountForActivity(post *Post) *Account {
+	account, err := post.Account()
+	if err != nil || account == nil {
+		logr.Errln("Error loading account", post.AccountId, "for activity about post", post.Id)
+		return AccountForOwner()
+	}
+	return account
+}
+
+func ActivityForPost(baseurl string, post *Post, activityType string) map[string]interface{} {
+	note := NoteForPost(baseurl, post)
+	id := note["id"].(string) + "#create"
+	if activityType != "Create" {
+		id = fmt.Sprintf("%s#%s-%d", note["id"], strings.ToLower(activityType), time.Now().Unix())
+	}
+
+	account := accountForActivity(post)
+	return map[string]interface{}{
+		"id":        id,
+		"type":      activityType,
+		"actor":     actorUrl(baseurl, account),
+		"published": note["published"],
+		"to":        []string{AS2_PUBLIC},
+		"cc":        []string{account.StreamUrl(baseurl) + "/followers"},
+		"object":    note,
+	}
+}
+
+func DeleteActivityForPost(baseurl string, post *Post) map[string]interface{} {
+	tombstone := TombstoneForPost(baseurl, post)
+	account := accountForActivity(post)
+	return map[string]interface{}{
+		"id":     tombstone["id"].(string) + "#delete",
+		"type":   "Delete",
+		"actor":  actorUrl(baseurl, account),
+		"to":     []string{AS2_PUBLIC},
+		"cc":     []string{account.StreamUrl(baseurl) + "/followers"},
+		"object": tombstone,
+	}
+}
+
+func signRequest(req *http.Request, body []byte, keyId string, key *rsa.PrivateKey) error {
+	digest := sha256.Sum256(body)
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	signedHeaders := []string{"(request-target)", "host", "date", "digest"}
+	signingString := fmt.Sprintf("(request-target): %s %s\nhost: %s\ndate: %s\ndigest: %s",
+		strings.ToLower(req.Method), req.URL.RequestURI(), req.URL.Host,
+		req.Header.Get("Date"), req.Header.Get("Digest"))
+
+	hashed := sha256.Sum256([]byte(signingString))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyId, strings.Join(signedHeaders, " "), base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+func deliverActivity(inbox string, body []byte, keyId string, key *rsa.PrivateKey) {
+	req, err := http.NewRequest("POST", inbox, bytes.NewReader(body))
+	if err != nil {
+		logr.Errln("Error creating request to deliver activity to", inbox, ":", err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", AS2_CONTENT_TYPE)
+	err = signRequest(req, body, keyId, key)
+	if err != nil {
+		logr.Errln("Error signing activity for", inbox, ":", err.Error())
+		return
+	}
+
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		logr.Errln("Error delivering activity to", inbox, ":", err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logr.Errln("Inbox", inbox, "rejected activity with status", resp.Status)
+		return
+	}
+
+	logr.Debugln("Delivered activity to", inbox)
+}
+
+// DeliverToFollowers sends the activity to the inboxes of the account's
+// followers.
+func DeliverToFollowers(account *Account, baseurl string, activity map[string]interface{}) {
+	logr.Debugln("Delivering ActivityPub activity to followers")
+
+	followers, err := FollowersForAccount(account.Id)
+	if err != nil {
+		logr.Errln("Error finding followers:", err.Error())
+		return
+	}
+	if len(followers) == 0 {
+		return
+	}
+
+	key, err := PrivateKeyForAccount(account)
+	if err != nil {
+		logr.Errln("Error loading actor key to sign activity:", err.Error())
+		return
+	}
+
+	activity["@context"] = AS2_CONTEXT
+	body, err := json.Marshal(activity)
+	if err != nil {
+		logr.Errln("Error marshaling activity for followers:", err.Error())
+		return
+	}
+
+	inboxes := make(map[string]bool)
+	for _, follower := range followers {
+		if inboxes[follower.Inbox] {
+			continue
+		}
+		inboxes[follower.Inbox] = true
+		inbox, keyId := follower.Inbox, actorKeyId(baseurl, account)
+		inBackground(func() { deliverActivity(inbox, body, keyId, key) })
+	}
+}
+
+func fetchActivityJson(fetchUrl string) (map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", fetchUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", AS2_CONTENT_TYPE)
+
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected response %s fetching %s", resp.Status, fetchUrl)
+	}
+
+	var data map[string]interface{}
+	dec := json.NewDecoder(io.LimitReader(resp.Body, MAX_ACTIVITY_SIZE))
+	err = dec.Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+var signatureParamRE = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// verifyRequestSignature checks the request's HTTP signature and returns the
+// id of the actor who owns the key that signed it.
+func verifyRequestSignature(r *http.Request, body []byte) (string, error) {
+	params := make(map[string]string)
+	for _, match := range signatureParamRE.FindAllStringSubmatch(r.Header.Get("Signature"), -1) {
+		params[match[1]] = match[2]
+	}
+	if params["keyId"] == "" || params["signature"] == "" {
+		return "", fmt.Errorf("Request is not signed")
+	}
+	if params["algorithm"] != "" && params["algorithm"] != "rsa-sha256" && params["algorithm"] != "hs2019" {
+		return "", fmt.Errorf("Unsupported signature algorithm %s", params["algorithm"])
+	}
+	signedHeaders := strings.Fields(strings.ToLower(params["headers"]))
+	if len(signedHeaders) == 0 {
+		signedHeaders = []string{"date"}
+	}
+
+	signed := make(map[string]bool)
+	lines := make([]string, len(signedHeaders))
+	for i, header := range signedHeaders {
+		var value string
+		switch header {
+		case "(request-target)":
+			value = strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			value = r.Host
+		default:
+			value = r.Header.Get(header)
+		}
+		signed[header] = true
+		lines[i] = header + ": " + value
+	}
+	// Without these, someone could replay the request later, or to somewhere
+	// else, or with a different body.
+	for _, header := range SIGNATURE_REQUIRED_HEADERS {
+		if !signed[header] {
+			return "", fmt.Errorf("Signature does not cover the %s header", header)
+		}
+	}
+
+	bodyDigest := sha256.Sum256(body)
+	expectedDigest := "SHA-256=" + base64.StdEncoding.EncodeToString(bodyDigest[:])
+	digestOk := false
+	for _, digest := range strings.Split(r.Header.Get("Digest"), ",") {
+		if strings.TrimSpace(digest) == expectedDigest {
+			digestOk = true
+		}
+	}
+	if !digestOk {
+		return "", fmt.Errorf("Request body does not match its digest")
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return "", fmt.Errorf("Could not parse request date: %s", err.Error())
+	}
+	if skew := time.Since(date); skew > SIGNATURE_DATE_WINDOW || skew < -SIGNATURE_DATE_WINDOW {
+		return "", fmt.Errorf("Request date %s is too far from now", date)
+	}
+
+	keyId := params["keyId"]
+	keyUrl, err := url.Parse(keyId)
+	if err != nil {
+		return "", err
+	}
+	keyUrl.Fragment = ""
+	fetchedDoc, err := fetchActivityJson(keyUrl.String())
+	if err != nil {
+		return "", err
+	}
+	keyDoc := fetchedDoc
+	if publicKey, ok := keyDoc["publicKey"].(map[string]interface{}); ok {
+		keyDoc = publicKey
+	}
+	if idOf(keyDoc) != keyId {
+		return "", fmt.Errorf("Could not find key %s", keyId)
+	}
+	owner := idOf(keyDoc["owner"])
+	err = checkKeyOwner(keyId, owner, fetchedDoc)
+	if err != nil {
+		return "", err
+	}
+	keyPem, _ := keyDoc["publicKeyPem"].(string)
+
+	block, _ := pem.Decode([]byte(keyPem))
+	if block == nil {
+		return "", fmt.Errorf("Could not decode PEM for key %s", keyId)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return "", fmt.Errorf("Key %s is not an RSA key", keyId)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return "", err
+	}
+	hashed := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	err = rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hashed[:], signature)
+	if err != nil {
+		return "", fmt.Errorf("Signature did not verify with key %s", keyId)
+	}
+
+	return owner, nil
+}
+
+// sameOrigin reports whether the URLs have the same scheme, host and port.
+func sameOrigin(a, b string) bool {
+	aUrl, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	bUrl, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return aUrl.Scheme != "" && aUrl.Host != "" &&
+		strings.EqualFold(aUrl.Scheme, bUrl.Scheme) && strings.EqualFold(aUrl.Host, bUrl.Host)
+}
+
+// hasPublicKey reports whether the actor document lists the key with the id.
+func hasPublicKey(actorDoc map[string]interface{}, keyId string) bool {
+	switch publicKey := actorDoc["publicKey"].(type) {
+	case map[string]interface{}:
+		return idOf(publicKey) == keyId
+	case []interface{}:
+		for _, key := range publicKey {
+			if idOf(key) == keyId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkKeyOwner makes sure the actor a key document names as its owner
+// really holds the key, as anyone can publish a key claiming to be someone
+// else's. The owner must be on the key's site and list the key in its own
+// actor document. fetchedDoc is what we fetched for the key, which may be
+// the owner's actor document already.
+func checkKeyOwner(keyId, owner string, fetchedDoc map[string]interface{}) error {
+	if owner == "" {
+		return fmt.Errorf("Key %s has no owner", keyId)
+	}
+	if !sameOrigin(keyId, owner) {
+		return fmt.Errorf("Key %s is not on the same site as its owner %s", keyId, owner)
+	}
+
+	ownerDoc := fetchedDoc
+	if idOf(fetchedDoc) != owner {
+		var err error
+		ownerDoc, err = fetchActivityJson(owner)
+		if err != nil {
+			return err
+		}
+		if idOf(ownerDoc) != owner {
+			return fmt.Errorf("Could not find key owner %s", owner)
+		}
+	}
+	if !hasPublicKey(ownerDoc, keyId) {
+		return fmt.Errorf("Key owner %s does not list key %s", owner, keyId)
+	}
+	return nil
+}
+
+func actor(w http.ResponseWriter, r *http.Request) {
+	baseurl := baseUrlFor(r)
+	account := accountForRequest(r)
+	streamurl := account.StreamUrl(baseurl)
+
+	key, err := PrivateKeyForAccount(account)
+	if err != nil {
+		logr.Errln("Error loading actor key:", err.Error())
+		http.Error(w, "error loading actor key", http.StatusInternalServerError)
+		return
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	publicKeyPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})
+
+	writeActivityStreams2(w, map[string]interface{}{
+		"id":                actorUrl(baseurl, account),
+		"type":              "Person",
+		"preferredUsername": account.Name,
+		"name":              account.DisplayName,
+		"url":               streamurl + "/",
+		"inbox":             streamurl + "/inbox",
+		"outbox":            streamurl + "/outbox",
+		"followers":         streamurl + "/followers",
+		"icon": map[string]interface{}{
+			"type":      "Image",
+			"mediaType": "image/jpeg",
+			"url":       baseurl + "/static/avatar-250.jpg",
+		},
+		"publicKey": map[string]interface{}{
+			"id":           actorKeyId(baseurl, account),
+			"owner":        actorUrl(baseurl, account),
+			"publicKeyPem": string(publicKeyPem),
+		},
+	})
+}
+
+func outbox(w http.ResponseWriter, r *http.Request) {
+	baseurl := baseUrlFor(r)
+	streamurl := accountForRequest(r).StreamUrl(baseurl)
+	writeStreamCollection(w, r, streamurl+"/outbox", func(post *Post) map[string]interface{} {
+		return ActivityForPost(baseurl, post, "Create")
+	})
+}
+
+func followers(w http.ResponseWriter, r *http.Request) {
+	baseurl := baseUrlFor(r)
+	account := accountForRequest(r)
+	followers, err := FollowersForAccount(account.Id)
+	if err != nil {
+		logr.Errln("Error loading followers:", err.Error())
+		http.Error(w, "error finding followers", http.StatusInternalServerError)
+		return
+	}
+
+	writeActivityStreams2(w, map[string]interface{}{
+		"id":         account.StreamUrl(baseurl) + "/followers",
+		"type":       "OrderedCollection",
+		"totalItems": len(followers),
+	})
+}
+
+func acceptFollow(account *Account, baseurl string, follow map[string]interface{}) {
+	actorId := idOf(follow["actor"])
+	actorDoc, err := fetchActivityJson(actorId)
+	if err != nil {
+		logr.Errln("Error fetching actor", actorId, "to accept their follow:", err.Error())
+		return
+	}
+	inbox, _ := actorDoc["inbox"].(string)
+	if inbox == "" {
+		logr.Errln("Actor", actorId, "has no inbox, so not accepting their follow")
+		return
+	}
+
+	follower, err := FollowerByActor(account.Id, actorId)
+	if err != nil {
+		logr.Errln("Error looking for existing follower", actorId, ":", err.Error())
+		return
+	}
+	if follower == nil {
+		follower = &Follower{0, account.Id, actorId, "", time.Now().UTC()}
+	}
+	follower.Inbox = inbox
+	if endpoints, ok := actorDoc["endpoints"].(map[string]interface{}); ok {
+		if sharedInbox, ok := endpoints["sharedInbox"].(string); ok && sharedInbox != "" {
+			follower.Inbox = sharedInbox
+		}
+	}
+	err = follower.Save()
+	if err != nil {
+		logr.Errln("Error saving follower", actorId, ":", err.Error())
+		return
+	}
+
+	key, err := PrivateKeyForAccount(account)
+	if err != nil {
+		logr.Errln("Error loading actor key to accept follow:", err.Error())
+		return
+	}
+	accept := map[string]interface{}{
+		"@context": AS2_CONTEXT,
+		"id":       fmt.Sprintf("%s#accept-%d", actorUrl(baseurl, account), time.Now().UnixNano()),
+		"type":     "Accept",
+		"actor":    actorUrl(baseurl, account),
+		"object":   follow,
+	}
+	body, err := json.Marshal(accept)
+	if err != nil {
+		logr.Errln("Error marshaling follow acceptance:", err.Error())
+		return
+	}
+	deliverActivity(inbox, body, actorKeyId(baseurl, account), key)
+}
+
+func inbox(w http.ResponseWriter, r *http.Request) {
+	logr.Debugln("Yay, an ActivityPub inbox request!")
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST is required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_ACTIVITY_SIZE))
+	if err != nil {
+		http.Error(w, "Could not read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	signer, err := verifyRequestSignature(r, body)
+	if err != nil {
+		logr.Debugln("Rejecting inbox request with bad signature:", err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var activity map[string]interface{}
+	err = json.Unmarshal(body, &activity)
+	if err != nil {
+		http.Error(w, "Could not parse activity: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if idOf(activity["actor"]) != signer {
+		http.Error(w, "Activity actor is not the signer", http.StatusForbidden)
+		return
+	}
+
+	baseurl := baseUrlFor(r)
+	account := accountForRequest(r)
+	activityType, _ := activity["type"].(string)
+	switch activityType {
+	case "Follow":
+		if idOf(activity["object"]) != actorUrl(baseurl, account) {
+			http.Error(w, "Can only follow "+actorUrl(baseurl, account), http.StatusBadRequest)
+			return
+		}
+		logr.Debugln("Yay,", signer, "wants to follow", account.Name)
+		inBackground(func() { acceptFollow(account, baseurl, activity) })
+
+	case "Undo":
+		undone, _ := activity["object"].(map[string]interface{})
+		if undone != nil && undone["type"] == "Follow" && idOf(undone["actor"]) == signer {
+			logr.Debugln(signer, "unfollowed", account.Name)
+			err = DeleteFollower(account.Id, signer)
+			if err != nil {
+				logr.Errln("Error removing follower", signer, ":", err.Error())
+				http.Error(w, "error removing follower", http.StatusInternalServerError)
+				return
+			}
+		}
+
+	default:
+		logr.Debugln("Ignoring", activityType, "activity from", signer)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// accountForResource returns the account a WebFinger resource names, either
+// as an acct: URI or by its stream or actor URL.
+func accountForResource(baseurl, host, resource string) (*Account, error) {
+	if strings.HasPrefix(resource, "acct:") {
+		at := strings.LastIndex(resource, "@")
+		if at < 0 || resource[at+1:] != host {
+			return nil, nil
+		}
+		return AccountByName(resource[len("acct:"):at])
+	}
+
+	if !strings.HasPrefix(resource, baseurl+"/") {
+		return nil, nil
+	}
+	path := strings.TrimSuffix(resource[len(baseurl):], "actor")
+	if path == "/" {
+		return AccountForOwner(), nil
+	}
+	if !strings.HasPrefix(path, "/~") || !strings.HasSuffix(path, "/") {
+		return nil, nil
+	}
+	account, err := AccountByName(path[len("/~") : len(path)-1])
+	if account == nil || err != nil || account.IsOwner() {
+		return nil, err
+	}
+	return account, nil
+}
+
+func webfinger(w http.ResponseWriter, r *http.Request) {
+	baseurl := baseUrlFor(r)
+
+	siteUrl, err := url.Parse(baseurl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resource := r.FormValue("resource")
+	if resource == "" {
+		http.Error(w, "resource is required", http.StatusBadRequest)
+		return
+	}
+	account, err := accountForResource(baseurl, siteUrl.Host, resource)
+	if err != nil {
+		logr.Errln("Error finding account for WebFinger resource", resource, ":", err.Error())
+		http.Error(w, "error finding account", http.StatusInternalServerError)
+		return
+	}
+	if account == nil {
+		http.NotFound(w, r)
+		return
+	}
+	subject := fmt.Sprintf("acct:%s@%s", account.Name, siteUrl.Host)
+	streamurl := account.StreamUrl(baseurl)
+
+	jrd, err := json.Marshal(map[string]interface{}{
+		"subject": subject,
+		"aliases": []string{streamurl + "/", actorUrl(baseurl, account)},
+		"links": []map[string]interface{}{
+			{"rel": "self", "type": AS2_CONTENT_TYPE, "href": actorUrl(baseurl, account)},
+			{"rel": "http://webfinger.net/rel/profile-page", "type": "text/html", "href": streamurl + "/"},
+		},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jrd+json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(jrd)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	AS2_CONTEXT      = "https://www.w3.org/ns/activitystreams"
+	AS2_PUBLIC       = "https://www.w3.org/ns/activitystreams#Public"
+	AS2_CONTENT_TYPE = "application/activity+json"
+	AS2_PAGE_SIZE    = 20
+)
+
+// WantsActivityStreams2 reports whether the request's Accept header asks for
+// ActivityStreams 2.0 JSON.
+func WantsActivityStreams2(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if mediaType == AS2_CONTENT_TYPE {
+			return true
+		}
+		if mediaType == "application/ld+json" && params["profile"] == AS2_CONTEXT {
+			return true
+		}
+	}
+	return false
+}
+
+func writeActivityStreams2(w http.ResponseWriter, data map[string]interface{}) {
+	writeActivityStreams2WithStatus(w, http.StatusOK, data)
+}
+
+// writeActivityStreams2WithStatus is like writeActivityStreams2, but responds
+// with the given status, once the headers are all set.
+func writeActivityStreams2WithStatus(w http.ResponseWriter, status int, data map[string]interface{}) {
+	data["@context"] = AS2_CONTEXT
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", AS2_CONTENT_TYPE)
+	w.WriteHeader(status)
+	w.Write(dataBytes)
+}
+
+func NoteForPost(baseurl string, post *Post) map[string]interface{} {
+	account := accountForActivity(post)
+	permalink := post.AbsolutePermalink(baseurl)
+	note := map[string]interface{}{
+		"id":           permalink,
+		"type":         "Note",
+		"url":          permalink,
+		"content":      post.Html,
+		"published":    post.PostedRFC3339(),
+		"attributedTo": actorUrl(baseurl, account),
+		"to":           []string{AS2_PUBLIC},
+	}
+
+	if !post.AuthorIsOwner() {
+		author, err := post.Author()
+		if err != nil {
+			logr.Errln("Error loading author", post.AuthorId, "for note", post.Id, ":", err.Error())
+			// but continue
+		} else {
+			note["attributedTo"] = author.Url
+		}
+	}
+
+	tags, err := post.Tags()
+	if err != nil {
+		logr.Errln("Error loading tags for note", post.Id, ":", err.Error())
+		// but continue
+	} else if len(tags) > 0 {
+		tagData := make([]map[string]interface{}, len(tags))
+		for i, tag := range tags {
+			tagData[i] = map[string]interface{}{
+				"type": "Hashtag",
+				"name": "#" + tag.Name,
+				"href": account.StreamUrl(baseurl) + tag.Permalink(),
+			}
+		}
+		note["tag"] = tagData
+	}
+
+	return note
+}
+
+func TombstoneForPost(baseurl string, post *Post) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         post.AbsolutePermalink(baseurl),
+		"type":       "Tombstone",
+		"formerType": "Note",
+		"deleted":    post.Deleted.Time.UTC().Format(time.RFC3339),
+	}
+}
+
+// writeStreamCollection writes the stream as an OrderedCollection with the
+// given id, or one page of it if the request asks for a page. Each post in
+// the page is represented by the item makeItem returns.
+func writeStreamCollection(w http.ResponseWriter, r *http.Request, collectionUrl string, makeItem func(*Post) map[string]interface{}) {
+	if r.FormValue("page") == "" {
+		writeActivityStreams2(w, map[string]interface{}{
+			"id":    collectionUrl,
+			"type":  "OrderedCollection",
+			"first": collectionUrl + "?page=true",
+		})
+		return
+	}
+
+	var posts []*Post
+	var err error
+	accountId := accountForRequest(r).Id
+	pageUrl := collectionUrl + "?page=true"
+	before := r.FormValue("before")
+	if before != "" {
+		var beforeTime time.Time
+		beforeTime, err = time.Parse(time.RFC3339, before)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid timestamp %s", before), http.StatusBadRequest)
+			return
+		}
+		posts, err = PostsBefore(accountId, beforeTime, AS2_PAGE_SIZE)
+		pageUrl += "&before=" + url.QueryEscape(before)
+	} else {
+		posts, err = RecentPosts(accountId, AS2_PAGE_SIZE)
+	}
+	if err != nil {
+		logr.Errln("Error loading posts for activity stream page:", err.Error())
+		http.Error(w, "error finding posts", http.StatusInternalServerError)
+		return
+	}
+
+	items := make([]map[string]interface{}, len(posts))
+	for i, post := range posts {
+		items[i] = makeItem(post)
+	}
+
+	page := map[string]interface{}{
+		"id":           pageUrl,
+		"type":         "OrderedCollectionPage",
+		"partOf":       collectionUrl,
+		"orderedItems": items,
+	}
+	if len(posts) == AS2_PAGE_SIZE {
+		lastPosted := posts[len(posts)-1].Posted.UTC().Format(time.RFC3339Nano)
+		page["next"] = collectionUrl + "?page=true&before=" + url.QueryEscape(lastPosted)
+	}
+	writeActivityStreams2(w, page)
+}
+
+func activityStream2(w http.ResponseWriter, r *http.Request) {
+	baseurl := baseUrlFor(r)
+	streamurl := accountForRequest(r).StreamUrl(baseurl)
+	writeStreamCollection(w, r, streamurl+"/", func(post *Post) map[string]interface{} {
+		return NoteForPost(baseurl, post)
+	})
+}
+
+func postActivityStream2(w http.ResponseWriter, r *http.Request, post *Post) {
+	baseurl := baseUrlFor(r)
+	if post.Deleted.Valid {
+		writeActivityStreams2WithStatus(w, http.StatusGone, TombstoneForPost(baseurl, post))
+		return
+	}
+	writeActivityStreams2(w, NoteForPost(baseurl, post))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"github.com/hoisie/mustache"
+	"net/http"
+	"time"
+)
+
+const (
+	AUDIT_LOGIN         = "login"
+	AUDIT_LOGIN_FAILED  = "login failed"
+	AUDIT_LOCKED_OUT    = "locked out"
+	AUDIT_CODE_FAILED   = "code failed"
+	AUDIT_RECOVERY_CODE = "recovery code used"
+
+	AUDIT_PAGE_SIZE = 100
+	// AUDIT_RETENTION is how long we keep audit events, so failed logins
+	// from strangers don't fill up the database.
+	AUDIT_RETENTION = 90 * 24 * time.Hour
+)
+
+type AuditEvent struct {
+	Id          int64
+	AccountName string
+	ClientAddr  string
+	Event       string
+	Created     time.Time
+}
+
+func NewAuditEvent() *AuditEvent {
+	return &AuditEvent{0, "", "", "", time.Now().UTC()}
+}
+
+func (e *AuditEvent) Save() error {
+	if e.Id == 0 {
+		return db.Insert(e)
+	}
+	_, err := db.Update(e)
+	return err
+}
+
+func (e *AuditEvent) CreatedDate() string {
+	return e.Created.Format("3:04:05 PM _2 Jan 2006")
+}
+
+// RecordAuditEvent saves a record of something that happened with an
+// account, logging (but otherwise ignoring) any error doing so.
+func RecordAuditEvent(name, addr, event string) {
+	if len([]rune(name)) > 100 {
+		name = string([]rune(name)[:100])
+	}
+
+	auditEvent := NewAuditEvent()
+	auditEvent.AccountName = name
+	auditEvent.ClientAddr = addr
+	auditEvent.Event = event
+	err := auditEvent.Save()
+	if err != nil {
+		logr.Errln("Error recording", event, "audit event for", name, ":", err.Error())
+	}
+}
+
+// DeleteOldAuditEvents removes events older than we keep them for, returning
+// how many there were.
+func DeleteOldAuditEvents() (int64, error) {
+	result, err := db.Exec("DELETE FROM audit WHERE created < $1", time.Now().UTC().Add(-AUDIT_RETENTION))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// RecentAuditEvents returns the latest events for the named account, or for
+// every account if name is empty.
+func RecentAuditEvents(name string, count int) ([]*AuditEvent, error) {
+	var rows []interface{}
+	var err error
+	if name == "" {
+		rows, err = db.Select(AuditEvent{},
+			"SELECT id, accountName, clientAddr, event, created FROM audit ORDER BY created DESC LIMIT $1",
+			count)
+	} else {
+		rows, err = db.Select(AuditEvent{},
+			"SELECT id, accountName, clientAddr, event, created FROM audit WHERE accountName = $1 ORDER BY created DESC LIMIT $2",
+			name, count)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*AuditEvent, len(rows))
+	for i, row := range rows {
+		events[i] = row.(*AuditEvent)
+	}
+	return events, nil
+}
+
+func audit(w http.ResponseWriter, r *http.Request) {
+	account := AccountAuthedInPerson(w, r)
+	if account == nil {
+		return
+	}
+
+	// The site owner sees events for every account, including failed logins
+	// for names that don't exist.
+	name := account.Name
+	if account.IsOwner() {
+		name = ""
+	}
+	events, err := RecentAuditEvents(name, AUDIT_PAGE_SIZE)
+	if err != nil {
+		logr.Errln("Error loading audit events:", err.Error())
+		http.Error(w, "error loading audit events", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"events":     events,
+		"OwnerName":  account.DisplayName,
+		"streampath": account.Path(),
+		"CsrfToken":  csrfTokenFor(r),
+	}
+	html := mustache.RenderFile("html/audit.html", data)
+	w.Write([]byte(html))
+}
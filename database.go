@@ -11,7 +11,7 @@ import (
 )
 
 const (
-	SCHEMA_VERSION = 1
+	SCHEMA_VERSION = 16
 )
 
 type Database struct {
@@ -25,6 +25,36 @@ type Version struct {
 	Upgraded time.Time
 }
 
+// Setting is a named value the site keeps for itself, such as a secret.
+type Setting struct {
+	Name  string
+	Value string
+}
+
+// SettingValue returns the named setting's value, making and saving one with
+// makeValue if there isn't one yet.
+func SettingValue(name string, makeValue func() (string, error)) (string, error) {
+	settings, err := db.Select(Setting{},
+		"SELECT name, value FROM setting WHERE name = $1",
+		name)
+	if err != nil {
+		return "", err
+	}
+	if len(settings) > 0 {
+		return settings[0].(*Setting).Value, nil
+	}
+
+	value, err := makeValue()
+	if err != nil {
+		return "", err
+	}
+	err = db.Insert(&Setting{name, value})
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
 func DatabaseVersion() (int, error) {
 	// Look what version of the database we're on (and try a query to make
 	// sure it worked anyway).
@@ -59,9 +89,22 @@ func OpenDatabase(dsn string, upgrading bool) (err error) {
 	dbmap.AddTableWithName(Author{}, "author").SetKeys(true, "Id")
 	dbmap.AddTableWithName(Post{}, "post").SetKeys(true, "Id")
 	dbmap.AddTableWithName(Writestream{}, "writestream").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Revision{}, "revision").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Tag{}, "tag").SetKeys(true, "Id")
 	dbmap.AddTableWithName(RssCloud{}, "rsscloud").SetKeys(true, "Id")
 	dbmap.AddTableWithName(Import{}, "import").SetKeys(true, "Id")
 	dbmap.AddTableWithName(Subscription{}, "subscription").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Delivery{}, "delivery").SetKeys(true, "Id")
+	dbmap.AddTableWithName(ActorKey{}, "actorkey").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Follower{}, "follower").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Webmention{}, "webmention").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Token{}, "token").SetKeys(true, "Id")
+	dbmap.AddTableWithName(AuthCode{}, "authcode").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Setting{}, "setting").SetKeys(false, "Name")
+	dbmap.AddTableWithName(Session{}, "session").SetKeys(true, "Id")
+	dbmap.AddTableWithName(AuditEvent{}, "audit").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Totp{}, "totp").SetKeys(true, "Id")
+	dbmap.AddTableWithName(RecoveryCode{}, "recoverycode").SetKeys(true, "Id")
 	dbmap.AddTableWithName(Version{}, "schema")
 
 	db = &Database{dbmap}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const (
+	// DELIVERY_MAX_ATTEMPTS is how many times we try to deliver a
+	// notification before giving up on it.
+	DELIVERY_MAX_ATTEMPTS = 8
+	// DELIVERY_BACKOFF is how long we wait after the first failed attempt,
+	// doubling after each one after that.
+	DELIVERY_BACKOFF = time.Minute
+	// DELIVERY_CONCURRENCY is how many notifications we send at once.
+	DELIVERY_CONCURRENCY = 4
+	DELIVERY_BATCH_SIZE  = 100
+	// DELIVERY_INTERVAL is how often we look for deliveries to retry.
+	DELIVERY_INTERVAL          = 30 * time.Second
+	MAX_DELIVERY_RESPONSE_SIZE = 64 * 1024
+	MAX_DELIVERY_STATUS_LENGTH = 100
+)
+
+// deliveryWake tells the delivery loop there are new deliveries to send.
+var deliveryWake = make(chan struct{}, 1)
+
+// Delivery is a notification queued to send to a hub subscriber.
+type Delivery struct {
+	Id             int64
+	SubscriptionId uint64
+	HubUrl         string
+	TopicUrl       string
+	ContentType    string
+	Body           string
+	Attempts       int
+	NextAttempt    time.Time
+	LastStatus     sql.NullString
+	Created        time.Time
+}
+
+func (d *Delivery) Save() error {
+	if d.Id == 0 {
+		return db.Insert(d)
+	}
+	_, err := db.Update(d)
+	return err
+}
+
+func (d *Delivery) Delete() error {
+	_, err := db.Delete(d)
+	return err
+}
+
+// QueueDeliveries queues the feed for delivery to each of the subscribers to
+// its topic, then wakes up the delivery loop to send them.
+func QueueDeliveries(subs []*Subscription, hub, topic, contentType, feed string) error {
+	now := time.Now().UTC()
+	rows := make([]interface{}, len(subs))
+	for i, sub := range subs {
+		rows[i] = &Delivery{0, sub.Id, hub, topic, contentType, feed, 0, now, sql.NullString{"", false}, now}
+	}
+
+	trans, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = trans.Insert(rows...)
+	if err != nil {
+		trans.Rollback()
+		return err
+	}
+	err = trans.Commit()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case deliveryWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func DueDeliveries(count int) ([]*Delivery, error) {
+	rows, err := db.Select(Delivery{},
+		"SELECT id, subscriptionId, hubUrl, topicUrl, contentType, body, attempts, nextAttempt, lastStatus, created FROM delivery WHERE nextAttempt <= $1 ORDER BY nextAttempt, id LIMIT $2",
+		time.Now().UTC(), count)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]*Delivery, len(rows))
+	for i, row := range rows {
+		deliveries[i] = row.(*Delivery)
+	}
+	return deliveries, nil
+}
+
+// backoffForAttempts returns how long to wait before trying a delivery again
+// after it failed the given number of times.
+func backoffForAttempts(attempts int) time.Duration {
+	return DELIVERY_BACKOFF << uint(attempts-1)
+}
+
+func truncateStatus(status string) string {
+	if len([]rune(status)) > MAX_DELIVERY_STATUS_LENGTH {
+		return string([]rune(status)[:MAX_DELIVERY_STATUS_LENGTH])
+	}
+	return status
+}
+
+// attemptDelivery tries to send the delivery once, then records how it went
+// on both the delivery and its subscription. Deliveries that succeed, or that
+// failed too many times, are removed from the queue. It returns false if it
+// couldn't get as far as trying, such as when the database is down.
+func attemptDelivery(d *Delivery) bool {
+	now := time.Now().UTC()
+	sub, err := SubscriptionById(d.SubscriptionId)
+	if err != nil {
+		logr.Errln("Error loading subscription", d.SubscriptionId, "for delivery", d.Id, ":", err.Error())
+		// Put it off rather than finding it due again straight away. This
+		// doesn't count as an attempt, as we never tried the subscriber.
+		d.NextAttempt = now.Add(DELIVERY_INTERVAL)
+		err = d.Save()
+		if err != nil {
+			logr.Errln("Error putting off delivery", d.Id, ":", err.Error())
+		}
+		return false
+	}
+	if sub == nil || sub.LeaseUntil.Before(now) {
+		logr.Debugln("Dropping delivery", d.Id, "as its subscription is gone or expired")
+		err = d.Delete()
+		if err != nil {
+			logr.Errln("Error deleting delivery", d.Id, ":", err.Error())
+			return false
+		}
+		return true
+	}
+
+	ok, status := sub.Deliver(d)
+	status = truncateStatus(status)
+
+	sub.RecordAttempt(ok, status)
+	err = sub.Save()
+	if err != nil {
+		logr.Errln("Error recording delivery status for subscription", sub.Id, ":", err.Error())
+		// but continue
+	}
+
+	d.Attempts++
+	d.LastStatus = sql.NullString{status, true}
+	if ok {
+		logr.Debugln("Delivered notification to", sub.Url)
+		err = d.Delete()
+	} else if d.Attempts >= DELIVERY_MAX_ATTEMPTS {
+		logr.Errln("Giving up delivering to", sub.Url, "after", d.Attempts, "attempts; last status:", status)
+		err = d.Delete()
+	} else {
+		d.NextAttempt = now.Add(backoffForAttempts(d.Attempts))
+		logr.Debugln("Delivery to", sub.Url, "failed with", status, "so trying again at", d.NextAttempt)
+		err = d.Save()
+	}
+	if err != nil {
+		logr.Errln("Error updating delivery", d.Id, ":", err.Error())
+		return false
+	}
+	return true
+}
+
+// DeliverDue sends the deliveries that are due, a few at a time, returning
+// whether there may be more. If any couldn't be handled there may be something
+// wrong with the database, so it says there aren't, and we wait a while.
+func DeliverDue() bool {
+	deliveries, err := DueDeliveries(DELIVERY_BATCH_SIZE)
+	if err != nil {
+		logr.Errln("Error finding deliveries to send:", err.Error())
+		return false
+	}
+
+	handled := make([]bool, len(deliveries))
+	slots := make(chan struct{}, DELIVERY_CONCURRENCY)
+	var sending sync.WaitGroup
+	for i, delivery := range deliveries {
+		i, delivery := i, delivery
+		slots <- struct{}{}
+		sending.Add(1)
+		go func() {
+			defer sending.Done()
+			defer func() { <-slots }()
+			handled[i] = attemptDelivery(delivery)
+		}()
+	}
+	sending.Wait()
+
+	for _, ok := range handled {
+		if !ok {
+			return false
+		}
+	}
+	return len(deliveries) == DELIVERY_BATCH_SIZE
+}
+
+// RunDeliveries sends queued deliveries as they come in or come due, until
+// stopping is closed. Deliveries not yet sent then stay queued for next time.
+func RunDeliveries(stopping <-chan struct{}) {
+	for {
+		more := DeliverDue()
+		if more {
+			select {
+			case <-stopping:
+				return
+			default:
+				continue
+			}
+		}
+
+		select {
+		case <-stopping:
+			return
+		case <-deliveryWake:
+		case <-time.After(DELIVERY_INTERVAL):
+		}
+	}
+}
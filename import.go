@@ -82,11 +82,12 @@ func indicesForEntity(ent map[string]interface{}) (int, int) {
 	return int(s), int(e)
 }
 
-func makeTweetMutations(data map[string]interface{}) MutationList {
+func makeTweetMutations(data map[string]interface{}) (MutationList, []string) {
 	text := data["text"].(string)
 	ents := data["entities"].(map[string]interface{})
 
 	mutations := list.New()
+	tags := make([]string, 0)
 	for _, entIf := range ents["user_mentions"].([]interface{}) {
 		ent := entIf.(map[string]interface{})
 		screenName := html.EscapeString(ent["screen_name"].(string))
@@ -98,6 +99,7 @@ func makeTweetMutations(data map[string]interface{}) MutationList {
 	for _, entIf := range ents["hashtags"].([]interface{}) {
 		ent := entIf.(map[string]interface{})
 		tagText := ent["text"].(string)
+		tags = append(tags, tagText)
 		html := fmt.Sprintf(`<a href="https://twitter.com/search?q=%%23%s">#%s</a>`,
 			tagText, tagText)
 		start, end := indicesForEntity(ent)
@@ -144,11 +146,11 @@ func makeTweetMutations(data map[string]interface{}) MutationList {
 		mutList[i] = el.Value.(Mutation)
 	}
 
-	return mutList
+	return mutList, tags
 }
 
-func mutateTweetText(data map[string]interface{}) string {
-	mutations := makeTweetMutations(data)
+func mutateTweetText(data map[string]interface{}) (string, []string) {
+	mutations, tags := makeTweetMutations(data)
 	sort.Sort(mutations)
 
 	var buf bytes.Buffer
@@ -164,10 +166,10 @@ func mutateTweetText(data map[string]interface{}) string {
 	// Include any trailing plain text.
 	buf.WriteString(string(text[i:]))
 
-	return buf.String()
+	return buf.String(), tags
 }
 
-func ImportJson(path string) {
+func ImportJson(path string, account *Account) {
 	logr.Debugln("Importing from Twitter export", path)
 	jsons, err := ioutil.ReadDir(path)
 	if err != nil {
@@ -226,6 +228,7 @@ func ImportJson(path string) {
 		} else {
 			post = NewPost()
 		}
+		post.AccountId = account.Id
 
 		tweetDate := data["created_at"].(string)
 		post.Posted, err = time.Parse(time.RubyDate, tweetDate)
@@ -276,11 +279,11 @@ func ImportJson(path string) {
 			origUrl := fmt.Sprintf("https://twitter.com/%s/status/%s", author.Name, tweetId)
 			post.Url = sql.NullString{origUrl, true}
 		} else {
-			// TODO: use author ID of site owner
-			post.AuthorId = 1
+			post.AuthorId = account.AuthorId
 		}
 
-		post.Html = mutateTweetText(tweetData)
+		var tags []string
+		post.Html, tags = mutateTweetText(tweetData)
 
 		// TODO: store the source?
 		// TODO: store the geoplace
@@ -291,6 +294,12 @@ func ImportJson(path string) {
 			return
 		}
 
+		err = post.SaveTags(tags)
+		if err != nil {
+			logr.Errln("Error saving tags for imported post", post.Id, ":", err.Error())
+			return
+		}
+
 		im.Value = post.Id
 		err = im.Save()
 		if err != nil {
@@ -304,7 +313,7 @@ func ImportJson(path string) {
 	logr.Debugln("Imported", count, "posts")
 }
 
-func ImportThinkup(path string) {
+func ImportThinkup(path string, account *Account) {
 	logr.Debugln("Importing from Thinkup export", path)
 	port, err := os.Open(path)
 	if err != nil {
@@ -366,6 +375,8 @@ func ImportThinkup(path string) {
 		} else {
 			post = NewPost()
 		}
+		post.AuthorId = account.AuthorId
+		post.AccountId = account.Id
 
 		post.Posted, err = time.Parse("2006-01-02 15:04:05", data["pub_date"])
 		if err != nil {
@@ -387,6 +398,12 @@ func ImportThinkup(path string) {
 			return
 		}
 
+		err = post.SaveTags(nil)
+		if err != nil {
+			logr.Errln("Error saving tags for imported post", post.Id, ":", err.Error())
+			return
+		}
+
 		im.Value = post.Id
 		err = im.Save()
 		if err != nil {
@@ -405,22 +422,26 @@ func ImportThinkup(path string) {
 	logr.Debugln("Finished importing", count, "posts!")
 }
 
-func ExportBackup(path string) {
+func ExportBackup(path string, account *Account) {
 	err := os.MkdirAll(path, os.ModeDir|0755)
 	if err != nil {
 		logr.Errln("Error creating path", path, "to save backup:", err.Error())
 		return
 	}
 
-	lastPosts, err := RecentPosts(1)
+	lastPosts, err := RecentPosts(account.Id, 1)
 	if err != nil {
 		logr.Errln("Error finding last post:", err.Error())
 		return
 	}
+	if len(lastPosts) == 0 {
+		logr.Debugln("Account", account.Name, "has no posts to back up")
+		return
+	}
 	lastTime := lastPosts[0].Posted.Add(1 * time.Second)
 
 	for {
-		posts, err := PostsBefore(lastTime, 30)
+		posts, err := PostsBefore(account.Id, lastTime, 30)
 		if err == sql.ErrNoRows {
 			logr.Debugln("Found no posts before", lastTime)
 			break
@@ -459,7 +480,7 @@ func ExportBackup(path string) {
 	}
 }
 
-func ImportBackup(path string) {
+func ImportBackup(path string, account *Account) {
 	logr.Debugln("Importing from cares export", path)
 	jsons, err := ioutil.ReadDir(path)
 	if err != nil {
@@ -495,7 +516,8 @@ func ImportBackup(path string) {
 		post := NewPost()
 		postId := data["Id"].(float64)
 		post.Id = int64(postId)
-		post.AuthorId = 1
+		post.AuthorId = account.AuthorId
+		post.AccountId = account.Id
 		post.Html = data["Html"].(string)
 		post.Posted, err = time.Parse(time.RFC3339, data["Posted"].(string))
 		if err != nil {
@@ -515,6 +537,12 @@ func ImportBackup(path string) {
 			return
 		}
 
+		err = post.SaveTags(nil)
+		if err != nil {
+			logr.Errln("Error saving tags for cares post imported from", datafilepath, ":", err.Error())
+			return
+		}
+
 		w := NewWritestream()
 		w.PostId = post.Id
 		w.Posted = post.Posted
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"github.com/bmizerany/pq"
+	"github.com/hoisie/mustache"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const AUTH_CODE_LIFETIME = 10 * time.Minute
+
+type AuthCode struct {
+	Id            int64
+	AccountId     int64
+	CodeHash      string
+	ClientId      string
+	RedirectUri   string
+	Scope         string
+	CodeChallenge sql.NullString
+	Created       time.Time
+	Used          pq.NullTime
+}
+
+// NewAuthCode makes an authorization code for the account, returning the code
+// and its secret value. As with tokens, only the value's hash is saved.
+func NewAuthCode(account *Account, clientId, redirectUri, scope, challenge string) (*AuthCode, string, error) {
+	value, err := RandomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	code := &AuthCode{0, account.Id, HashToken(value), clientId, redirectUri, NormalizeScope(scope),
+		sql.NullString{challenge, challenge != ""}, time.Now().UTC(), pq.NullTime{time.Unix(0, 0), false}}
+	return code, value, nil
+}
+
+func (c *AuthCode) Save() error {
+	if c.Id == 0 {
+		return db.Insert(c)
+	}
+	_, err := db.Update(c)
+	return err
+}
+
+func (c *AuthCode) MarkUsed() error {
+	c.Used = pq.NullTime{time.Now().UTC(), true}
+	return c.Save()
+}
+
+// HasVerifier checks the PKCE code verifier matches the code's S256 challenge.
+// Codes requested without a challenge need no verifier.
+func (c *AuthCode) HasVerifier(verifier string) bool {
+	if !c.CodeChallenge.Valid {
+		return verifier == ""
+	}
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:]) == c.CodeChallenge.String
+}
+
+// AuthCodeByValue finds the unused, unexpired code with the given secret value.
+func AuthCodeByValue(value string) (*AuthCode, error) {
+	rows, err := db.Select(AuthCode{},
+		"SELECT id, accountId, codeHash, clientId, redirectUri, scope, codeChallenge, created, used FROM authcode WHERE codeHash = $1 AND used IS NULL AND created > $2",
+		HashToken(value), time.Now().UTC().Add(-AUTH_CODE_LIFETIME))
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].(*AuthCode), nil
+}
+
+// issuerUrl returns the URL identifying this site as an authorization server.
+func issuerUrl(baseurl string) string {
+	return baseurl + "/"
+}
+
+// profileUrl returns the URL identifying the account to IndieAuth clients.
+func profileUrl(baseurl string, account *Account) string {
+	return account.StreamUrl(baseurl) + "/"
+}
+
+// clientFromForm reads and checks the client_id and redirect_uri of an
+// IndieAuth request. We don't fetch the client's page to discover other
+// redirect URLs, so the redirect must be on the client's own host.
+func clientFromForm(r *http.Request) (clientId, redirectUri string, err error) {
+	clientId, redirectUri = r.FormValue("client_id"), r.FormValue("redirect_uri")
+
+	clientUrl, err := url.Parse(clientId)
+	if err != nil || (clientUrl.Scheme != "http" && clientUrl.Scheme != "https") || clientUrl.Host == "" {
+		return "", "", fmt.Errorf("Client ID %s is not an http or https URL", clientId)
+	}
+	redirectUrl, err := url.Parse(redirectUri)
+	if err != nil || redirectUrl.Scheme != clientUrl.Scheme || redirectUrl.Host != clientUrl.Host {
+		return "", "", fmt.Errorf("Redirect URL %s is not on client %s", redirectUri, clientId)
+	}
+	return clientId, redirectUri, nil
+}
+
+// redeemAuthCode checks and uses up the code in an authorization code
+// redemption request, writing an OAuth error if it isn't good.
+func redeemAuthCode(w http.ResponseWriter, r *http.Request) (*AuthCode, bool) {
+	code, err := AuthCodeByValue(r.PostFormValue("code"))
+	if err != nil {
+		logr.Errln("Error loading authorization code:", err.Error())
+		http.Error(w, "error loading authorization code", http.StatusInternalServerError)
+		return nil, false
+	}
+	if code == nil {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_grant", "The code is unknown, expired or already used")
+		return nil, false
+	}
+	if code.ClientId != r.PostFormValue("client_id") || code.RedirectUri != r.PostFormValue("redirect_uri") {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_grant", "The code was issued to a different client")
+		return nil, false
+	}
+	if !code.HasVerifier(r.PostFormValue("code_verifier")) {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_grant", "The code verifier does not match the challenge")
+		return nil, false
+	}
+
+	err = code.MarkUsed()
+	if err != nil {
+		logr.Errln("Error using up authorization code", code.Id, ":", err.Error())
+		http.Error(w, "error saving authorization code", http.StatusInternalServerError)
+		return nil, false
+	}
+	return code, true
+}
+
+func approveAuthorization(w http.ResponseWriter, r *http.Request) {
+	account := AccountLoggedIn(w, r)
+	if account == nil {
+		return
+	}
+	clientId, redirectUri, err := clientFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	scope := strings.Join(r.PostForm["scope"], " ")
+	code, value, err := NewAuthCode(account, clientId, redirectUri, scope, r.PostFormValue("code_challenge"))
+	if err != nil {
+		logr.Errln("Error making authorization code:", err.Error())
+		http.Error(w, "error making authorization code", http.StatusInternalServerError)
+		return
+	}
+	err = code.Save()
+	if err != nil {
+		logr.Errln("Error saving authorization code:", err.Error())
+		http.Error(w, "error saving authorization code", http.StatusInternalServerError)
+		return
+	}
+
+	redirectUrl, _ := url.Parse(redirectUri)
+	query := redirectUrl.Query()
+	query.Set("code", value)
+	query.Set("state", r.PostFormValue("state"))
+	query.Set("iss", issuerUrl(baseUrlFor(r)))
+	redirectUrl.RawQuery = query.Encode()
+
+	logr.Debugln("Authorized", clientId, "for scope", code.Scope)
+	http.Redirect(w, r, redirectUrl.String(), http.StatusFound)
+}
+
+func authorizationEndpoint(w http.ResponseWriter, r *http.Request) {
+	logr.Debugln("Yay, an authorization request!")
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		if r.PostFormValue("code") == "" {
+			approveAuthorization(w, r)
+			return
+		}
+
+		// Redeeming a code here only proves who the user is.
+		code, ok := redeemAuthCode(w, r)
+		if !ok {
+			return
+		}
+		account, err := AccountById(code.AccountId)
+		if err != nil || account == nil {
+			logr.Errln("Error loading account", code.AccountId, "for authorization code", code.Id)
+			http.Error(w, "error loading account", http.StatusInternalServerError)
+			return
+		}
+		logr.Debugln("Redeemed authorization code", code.Id, "for profile")
+		writeMicropubJson(w, http.StatusOK, map[string]interface{}{
+			"me": profileUrl(baseUrlFor(r), account),
+		})
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "GET or POST is required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if responseType := r.FormValue("response_type"); responseType != "" && responseType != "code" {
+		http.Error(w, fmt.Sprintf("Unsupported response type %s", responseType), http.StatusBadRequest)
+		return
+	}
+	clientId, redirectUri, err := clientFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	challenge := r.FormValue("code_challenge")
+	if method := r.FormValue("code_challenge_method"); challenge != "" && method != "S256" {
+		http.Error(w, fmt.Sprintf("Unsupported code challenge method %s", method), http.StatusBadRequest)
+		return
+	}
+	// Approving needs a login session, so send people to log in before they
+	// get as far as the form.
+	account := AccountLoggedIn(w, r)
+	if account == nil {
+		return
+	}
+
+	requested := strings.Fields(r.FormValue("scope"))
+	scopes := make([]map[string]interface{}, len(TOKEN_SCOPES))
+	for i, scope := range TOKEN_SCOPES {
+		wanted := false
+		for _, req := range requested {
+			wanted = wanted || req == scope
+		}
+		scopes[i] = map[string]interface{}{"Name": scope, "Requested": wanted}
+	}
+
+	data := map[string]interface{}{
+		"ClientId":      clientId,
+		"RedirectUri":   redirectUri,
+		"State":         r.FormValue("state"),
+		"CodeChallenge": challenge,
+		"Scopes":        scopes,
+		"OwnerName":     account.DisplayName,
+		"streampath":    account.Path(),
+		"CsrfToken":     csrfTokenFor(r),
+	}
+	html := mustache.RenderFile("html/authorize.html", data)
+	w.Write([]byte(html))
+}
+
+func verifyTokenRequest(w http.ResponseWriter, r *http.Request) {
+	token, err := TokenByValue(bearerTokenValue(r))
+	if err != nil {
+		logr.Errln("Error checking bearer token:", err.Error())
+		http.Error(w, "error loading auth information", http.StatusInternalServerError)
+		return
+	}
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="cares", error="invalid_token"`)
+		writeMicropubError(w, http.StatusUnauthorized, "invalid_token", "The token is unknown or revoked")
+		return
+	}
+	account, err := AccountById(token.AccountId)
+	if err != nil || account == nil {
+		logr.Errln("Error loading account", token.AccountId, "for token", token.Id)
+		http.Error(w, "error loading auth information", http.StatusInternalServerError)
+		return
+	}
+
+	writeMicropubJson(w, http.StatusOK, map[string]interface{}{
+		"me":        profileUrl(baseUrlFor(r), account),
+		"client_id": token.Name,
+		"scope":     token.Scope,
+	})
+}
+
+func revokeTokenRequest(w http.ResponseWriter, r *http.Request) {
+	token, err := TokenByValue(r.PostFormValue("token"))
+	if err != nil {
+		logr.Errln("Error loading token to revoke:", err.Error())
+		http.Error(w, "error loading token", http.StatusInternalServerError)
+		return
+	}
+	// Revoking an unknown token succeeds too, so as not to reveal anything.
+	if token != nil {
+		err = token.Revoke()
+		if err != nil {
+			logr.Errln("Error revoking token", token.Id, ":", err.Error())
+			http.Error(w, "error revoking token", http.StatusInternalServerError)
+			return
+		}
+		logr.Debugln("Revoked token", token.Id, "by request")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func tokenEndpoint(w http.ResponseWriter, r *http.Request) {
+	logr.Debugln("Yay, a token request!")
+
+	if r.Method == "GET" {
+		verifyTokenRequest(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "GET or POST is required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+	if r.PostFormValue("action") == "revoke" || (r.PostFormValue("grant_type") == "" && r.PostFormValue("token") != "") {
+		revokeTokenRequest(w, r)
+		return
+	}
+	if grantType := r.PostFormValue("grant_type"); grantType != "authorization_code" {
+		writeMicropubError(w, http.StatusBadRequest, "unsupported_grant_type", fmt.Sprintf("Unsupported grant type %s", grantType))
+		return
+	}
+
+	code, ok := redeemAuthCode(w, r)
+	if !ok {
+		return
+	}
+	if code.Scope == "" {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_grant", "The code grants no scope, so can't be exchanged for a token")
+		return
+	}
+
+	account, err := AccountById(code.AccountId)
+	if err != nil || account == nil {
+		logr.Errln("Error loading account", code.AccountId, "for authorization code", code.Id)
+		http.Error(w, "error loading account", http.StatusInternalServerError)
+		return
+	}
+	token, value, err := NewToken(account, code.ClientId, code.Scope)
+	if err == nil {
+		err = token.Save()
+	}
+	if err != nil {
+		logr.Errln("Error issuing token for authorization code", code.Id, ":", err.Error())
+		http.Error(w, "error issuing token", http.StatusInternalServerError)
+		return
+	}
+
+	logr.Debugln("Issued token", token.Id, "to", code.ClientId)
+	w.Header().Set("Cache-Control", "no-store")
+	writeMicropubJson(w, http.StatusOK, map[string]interface{}{
+		"access_token": value,
+		"token_type":   "Bearer",
+		"scope":        token.Scope,
+		"me":           profileUrl(baseUrlFor(r), account),
+	})
+}
+
+func authorizationServerMetadata(w http.ResponseWriter, r *http.Request) {
+	baseurl := baseUrlFor(r)
+	writeMicropubJson(w, http.StatusOK, map[string]interface{}{
+		"issuer":                 issuerUrl(baseurl),
+		"authorization_endpoint": baseurl + "/auth",
+		"token_endpoint":         baseurl + "/token",
+		"revocation_endpoint":    baseurl + "/token",
+		"revocation_endpoint_auth_methods_supported":     []string{"none"},
+		"scopes_supported":                               TOKEN_SCOPES,
+		"response_types_supported":                       []string{"code"},
+		"grant_types_supported":                          []string{"authorization_code"},
+		"code_challenge_methods_supported":               []string{"S256"},
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+// tokens lets an account holder see, issue and revoke their tokens by hand.
+func tokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "GET or POST is required", http.StatusMethodNotAllowed)
+		return
+	}
+	account := AccountAuthedInPerson(w, r)
+	if account == nil {
+		return
+	}
+
+	newTokenValue := ""
+	if r.Method == "POST" {
+		r.ParseForm()
+		if revoke := r.PostFormValue("revoke"); revoke != "" {
+			id, err := strconv.ParseInt(revoke, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid token id", http.StatusBadRequest)
+				return
+			}
+			token, err := TokenById(account.Id, id)
+			if err == nil && token != nil {
+				err = token.Revoke()
+			}
+			if err != nil {
+				logr.Errln("Error revoking token", id, ":", err.Error())
+				http.Error(w, "error revoking token", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/tokens", http.StatusSeeOther)
+			return
+		}
+
+		name := strings.TrimSpace(r.PostFormValue("name"))
+		if name == "" {
+			http.Error(w, "a name is required", http.StatusBadRequest)
+			return
+		}
+		scope := NormalizeScope(strings.Join(r.PostForm["scope"], " "))
+		if scope == "" {
+			http.Error(w, "at least one scope is required", http.StatusBadRequest)
+			return
+		}
+		token, value, err := NewToken(account, name, scope)
+		if err == nil {
+			err = token.Save()
+		}
+		if err != nil {
+			logr.Errln("Error making token:", err.Error())
+			http.Error(w, "error making token", http.StatusInternalServerError)
+			return
+		}
+		newTokenValue = value
+	}
+
+	tokenList, err := ActiveTokensForAccount(account.Id)
+	if err != nil {
+		logr.Errln("Error loading tokens:", err.Error())
+		http.Error(w, "error loading tokens", http.StatusInternalServerError)
+		return
+	}
+
+	scopes := make([]map[string]interface{}, len(TOKEN_SCOPES))
+	for i, scope := range TOKEN_SCOPES {
+		scopes[i] = map[string]interface{}{"Name": scope}
+	}
+	data := map[string]interface{}{
+		"tokens":        tokenList,
+		"Scopes":        scopes,
+		"NewTokenValue": newTokenValue,
+		"OwnerName":     account.DisplayName,
+		"streampath":    account.Path(),
+		"CsrfToken":     csrfTokenFor(r),
+	}
+	html := mustache.RenderFile("html/tokens.html", data)
+	w.Write([]byte(html))
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"bufio"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 )
 
 func Prompt(prompt string) (ret string) {
@@ -25,16 +27,35 @@ func Prompt(prompt string) (ret string) {
 	return
 }
 
+// Say tells the person running an interactive command something, on the
+// terminal rather than in the logs.
+func Say(a ...interface{}) {
+	fmt.Fprintln(os.Stdout, a...)
+}
+
 func MakeAccount() {
 	var err error
 
 	name := Prompt("Name: ")
+	if !IsValidAccountName(name) {
+		logr.Errln("Account names are up to 64 letters, numbers, dots, dashes and underscores, starting with a letter or number")
+		return
+	}
 	pass := Prompt("Password: ")
 	displayName := Prompt("Display name: ")
 
+	// The first account is the site owner, whose stream is the whole site.
+	err = LoadAccountForOwner()
+	if err != nil {
+		logr.Errln("Error loading site owner:", err.Error())
+		return
+	}
 	author := NewAuthor()
 	author.Name = displayName
 	author.Url = "/"
+	if AccountForOwner() != nil {
+		author.Url = "/~" + name + "/"
+	}
 	err = author.Save()
 	if err != nil {
 		logr.Errln("Error saving new account:", err.Error())
@@ -45,27 +66,73 @@ func MakeAccount() {
 	account.Name = name
 	account.DisplayName = displayName
 	account.SetPassword(pass)
+	account.AuthorId = author.Id
 	err = account.Save()
 	if err != nil {
 		logr.Errln("Error saving new account:", err.Error())
 		return
 	}
+
+	if strings.HasPrefix(strings.ToLower(Prompt("Set up two-factor authentication? [y/N] ")), "y") {
+		EnrolTotp(account)
+	}
+}
+
+// accountForImport returns the named account to import or back up posts for,
+// or the site owner if no name is given.
+func accountForImport(name string) *Account {
+	if name == "" {
+		err := LoadAccountForOwner()
+		if err != nil {
+			logr.Errln("Error loading site owner:", err.Error())
+			return nil
+		}
+		if AccountForOwner() == nil {
+			logr.Errln("There are no accounts yet; make one with --make-account")
+		}
+		return AccountForOwner()
+	}
+
+	account, err := AccountByName(name)
+	if err != nil {
+		logr.Errln("Error loading account", name, ":", err.Error())
+		return nil
+	}
+	if account == nil {
+		logr.Errln("No such account", name)
+	}
+	return account
 }
 
 func main() {
 	var dsn string
 	var makeaccount, initdb, upgradedb bool
-	var importthinkup, importjson, backup, importbackup string
-	var port int
+	var importthinkup, importjson, backup, importbackup, accountname string
+	var enroltotp, disabletotp string
+	var trustedproxies, outboundallow string
+	var port, redirectport int
+	var tlscert, tlskey string
+	var purgedeleted time.Duration
 	flag.StringVar(&dsn, "database", "dbname=cares sslmode=disable", "database connection info")
 	flag.BoolVar(&makeaccount, "make-account", false, "create a new account interactively")
+	flag.StringVar(&enroltotp, "enrol-totp", "", "set up two-factor authentication for the named account interactively")
+	flag.StringVar(&disabletotp, "disable-totp", "", "turn off two-factor authentication for the named account")
 	flag.BoolVar(&initdb, "init-db", false, "initialize the database")
 	flag.BoolVar(&upgradedb, "upgrade-db", false, "upgrade the database schema")
 	flag.StringVar(&importthinkup, "import-thinkup", "", "path to a Thinkup CSV export to import")
 	flag.StringVar(&importjson, "import-json", "", "path to a directory of Twitter JSON to import")
 	flag.StringVar(&backup, "backup", "", "path to which to save a backup of the current tweets")
 	flag.StringVar(&importbackup, "import-backup", "", "path to a cares backup to import")
+	flag.StringVar(&accountname, "account", "", "name of the account to import or back up posts for (default the site owner)")
+	flag.DurationVar(&purgedeleted, "purge-deleted-older-than", 0, "permanently remove posts deleted longer ago than this (such as 720h)")
 	flag.IntVar(&port, "port", 8080, "port on which to serve the web interface")
+	flag.StringVar(&tlscert, "tls-cert", "", "path to a TLS certificate (with any intermediates) to serve HTTPS with, reloaded when it changes")
+	flag.StringVar(&tlskey, "tls-key", "", "path to the TLS certificate's private key")
+	flag.IntVar(&redirectport, "http-redirect-port", 0, "port on which to redirect plain HTTP to HTTPS, when serving with --tls-cert")
+	flag.StringVar(&siteBaseUrl, "base-url", "", "canonical URL of the site, such as https://example.com (used for all links and feeds, for the RSS feed's rssCloud element, and for notifying subscribers of scheduled posts)")
+	flag.StringVar(&hubSignatureMethod, "hub-signature", "sha256", "hash to sign hub notifications with (sha1, sha256, sha384 or sha512)")
+	flag.StringVar(&outboundallow, "outbound-allow", "", "comma separated addresses or CIDR ranges of private networks that subscriber callbacks and other outgoing requests may reach anyway")
+	flag.StringVar(&trustedproxies, "trusted-proxies", "", "comma separated addresses or CIDR ranges of reverse proxies whose Forwarded and X-Forwarded-* headers to trust")
 	flag.Parse()
 
 	err := SetUpLogger()
@@ -75,6 +142,23 @@ func main() {
 	}
 	defer logr.Close()
 
+	if _, ok := HUB_SIGNATURE_METHODS[hubSignatureMethod]; !ok {
+		logr.Errln("Unknown --hub-signature hash", hubSignatureMethod)
+		return
+	}
+
+	err = SetTrustedProxies(trustedproxies)
+	if err != nil {
+		logr.Errln("Error reading --trusted-proxies:", err.Error())
+		return
+	}
+
+	err = SetOutboundAllowlist(outboundallow)
+	if err != nil {
+		logr.Errln("Error reading --outbound-allow:", err.Error())
+		return
+	}
+
 	err = OpenDatabase(dsn, initdb || upgradedb)
 	if err != nil {
 		logr.Errln("Error connecting to database:", err.Error())
@@ -87,15 +171,35 @@ func main() {
 		UpgradeDatabase()
 	} else if makeaccount {
 		MakeAccount()
-	} else if importjson != "" {
-		ImportJson(importjson)
-	} else if importthinkup != "" {
-		ImportThinkup(importthinkup)
-	} else if importbackup != "" {
-		ImportBackup(importbackup)
-	} else if backup != "" {
-		ExportBackup(backup)
+	} else if enroltotp != "" {
+		ManageTotp(enroltotp, false)
+	} else if disabletotp != "" {
+		ManageTotp(disabletotp, true)
+	} else if importjson != "" || importthinkup != "" || importbackup != "" || backup != "" {
+		account := accountForImport(accountname)
+		if account == nil {
+			return
+		}
+		if importjson != "" {
+			ImportJson(importjson, account)
+		} else if importthinkup != "" {
+			ImportThinkup(importthinkup, account)
+		} else if importbackup != "" {
+			ImportBackup(importbackup, account)
+		} else {
+			ExportBackup(backup, account)
+		}
+	} else if purgedeleted > 0 {
+		PurgeDeleted(purgedeleted)
 	} else {
-		ServeWeb(port)
+		if (tlscert == "") != (tlskey == "") {
+			logr.Errln("Both --tls-cert and --tls-key are needed to serve HTTPS")
+			return
+		}
+		if redirectport != 0 && tlscert == "" {
+			logr.Errln("--http-redirect-port needs --tls-cert and --tls-key to redirect to HTTPS")
+			return
+		}
+		ServeWeb(port, tlscert, tlskey, redirectport)
 	}
 }
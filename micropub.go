@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const MAX_MICROPUB_REQUEST_SIZE = 1 << 20
+
+type MicropubRequest struct {
+	Type       []string                 `json:"type"`
+	Properties map[string][]interface{} `json:"properties"`
+	Action     string                   `json:"action"`
+	Url        string                   `json:"url"`
+	Replace    map[string][]interface{} `json:"replace"`
+	Add        map[string][]interface{} `json:"add"`
+	Delete     interface{}              `json:"delete"`
+}
+
+func writeMicropubJson(w http.ResponseWriter, status int, data interface{}) {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(dataBytes)
+}
+
+func writeMicropubError(w http.ResponseWriter, status int, code, description string) {
+	writeMicropubJson(w, status, map[string]interface{}{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// micropubRequestFromForm converts a form-encoded Micropub request into the
+// same shape as a JSON one.
+func micropubRequestFromForm(r *http.Request) *MicropubRequest {
+	req := &MicropubRequest{
+		Action:     r.PostFormValue("action"),
+		Url:        r.PostFormValue("url"),
+		Properties: make(map[string][]interface{}),
+	}
+	if h := r.PostFormValue("h"); h != "" {
+		req.Type = []string{"h-" + h}
+	}
+
+	for key, values := range r.PostForm {
+		switch key {
+		case "h", "action", "url", "access_token":
+			continue
+		case "content[html]":
+			for _, value := range values {
+				req.Properties["content"] = append(req.Properties["content"], map[string]interface{}{"html": value})
+			}
+			continue
+		}
+
+		key = strings.TrimSuffix(key, "[]")
+		for _, value := range values {
+			req.Properties[key] = append(req.Properties[key], value)
+		}
+	}
+	return req
+}
+
+func micropubStrings(values []interface{}) []string {
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		if str, ok := value.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
+
+// micropubContentHtml makes post HTML from a Micropub content value, which is
+// either plain text or an object with the HTML.
+func micropubContentHtml(values []interface{}) (string, error) {
+	if len(values) == 0 {
+		return "", nil
+	}
+
+	switch content := values[0].(type) {
+	case string:
+		text := html.EscapeString(content)
+		return strings.Replace(text, "\n", "<br>\n", -1), nil
+	case map[string]interface{}:
+		if contentHtml, ok := content["html"].(string); ok {
+			return CleanHTML(contentHtml)
+		}
+		if value, ok := content["value"].(string); ok {
+			return html.EscapeString(value), nil
+		}
+	}
+	return "", fmt.Errorf("Could not understand content value")
+}
+
+func micropubCreate(w http.ResponseWriter, r *http.Request, req *MicropubRequest, account *Account) {
+	// Posts are entries unless the client says otherwise.
+	if len(req.Type) > 1 || (len(req.Type) == 1 && req.Type[0] != "h-entry") {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", "Only h-entry posts are supported")
+		return
+	}
+
+	postHtml, err := micropubContentHtml(req.Properties["content"])
+	if err != nil {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", "Error reading content: "+err.Error())
+		return
+	}
+	if postHtml == "" {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", "content is required")
+		return
+	}
+
+	post := NewPost()
+	post.AuthorId = account.AuthorId
+	post.AccountId = account.Id
+	post.Html = postHtml
+
+	if published := micropubStrings(req.Properties["published"]); len(published) > 0 {
+		post.Posted, err = time.Parse(time.RFC3339, published[0])
+		if err != nil {
+			writeMicropubError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("invalid published time %s", published[0]))
+			return
+		}
+		if post.Posted.After(time.Now()) {
+			if siteBaseUrl == "" {
+				writeMicropubError(w, http.StatusBadRequest, "invalid_request", SCHEDULING_NEEDS_BASE_URL)
+				return
+			}
+			post.Status = POST_SCHEDULED
+		}
+	}
+	if status := micropubStrings(req.Properties["post-status"]); len(status) > 0 && status[0] == "draft" {
+		post.Status = POST_DRAFT
+	}
+
+	if post.Status == POST_PUBLISHED {
+		err = post.Publish()
+	} else {
+		err = post.Save()
+	}
+	if err != nil {
+		logr.Errln("Error saving new Micropub post:", err.Error())
+		writeMicropubError(w, http.StatusInternalServerError, "server_error", "error saving post to database")
+		return
+	}
+
+	err = post.SaveTags(micropubStrings(req.Properties["category"]))
+	if err != nil {
+		logr.Errln("Error saving tags for new Micropub post", post.Id, ":", err.Error())
+		// but continue
+	}
+
+	baseurl := baseUrlFor(r)
+	if post.Status == POST_PUBLISHED {
+		notifyOfPost(baseurl, post)
+	}
+
+	w.Header().Set("Location", post.AbsolutePermalink(baseurl))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func micropubUpdate(w http.ResponseWriter, r *http.Request, req *MicropubRequest, post *Post) {
+	if post.Deleted.Valid {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", "cannot update a deleted post")
+		return
+	}
+
+	newHtml := post.Html
+	if content, ok := req.Replace["content"]; ok {
+		var err error
+		newHtml, err = micropubContentHtml(content)
+		if err != nil {
+			writeMicropubError(w, http.StatusBadRequest, "invalid_request", "Error reading content: "+err.Error())
+			return
+		}
+		if newHtml == "" {
+			writeMicropubError(w, http.StatusBadRequest, "invalid_request", "content cannot be empty")
+			return
+		}
+	}
+
+	tags, err := post.Tags()
+	if err != nil {
+		logr.Errln("Error loading tags for post", post.Id, ":", err.Error())
+		writeMicropubError(w, http.StatusInternalServerError, "server_error", "error loading post's tags")
+		return
+	}
+	categories := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		categories = append(categories, tag.Name)
+	}
+	if replaced, ok := req.Replace["category"]; ok {
+		categories = micropubStrings(replaced)
+	}
+	categories = append(categories, micropubStrings(req.Add["category"])...)
+
+	removed := make(map[string]bool)
+	switch deletes := req.Delete.(type) {
+	case []interface{}:
+		// Deleting whole properties.
+		for _, prop := range micropubStrings(deletes) {
+			if prop == "category" {
+				categories = nil
+			}
+		}
+	case map[string]interface{}:
+		if values, ok := deletes["category"].([]interface{}); ok {
+			for _, value := range micropubStrings(values) {
+				removed[NormalizeTag(value)] = true
+			}
+		}
+	}
+	keptCategories := make([]string, 0, len(categories))
+	for _, category := range categories {
+		if !removed[NormalizeTag(category)] {
+			keptCategories = append(keptCategories, category)
+		}
+	}
+
+	revised := newHtml != post.Html
+	if revised {
+		err = post.Revise(newHtml)
+		if err != nil {
+			logr.Errln("Error saving Micropub revision of post", post.Id, ":", err.Error())
+			writeMicropubError(w, http.StatusInternalServerError, "server_error", "error saving post to database")
+			return
+		}
+	}
+	err = post.SaveTags(keptCategories)
+	if err != nil {
+		logr.Errln("Error saving tags for post", post.Id, ":", err.Error())
+		// but continue
+	}
+
+	if revised && post.Status == POST_PUBLISHED {
+		notifyOfRevision(baseUrlFor(r), post)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func micropubAction(w http.ResponseWriter, r *http.Request, req *MicropubRequest, account *Account) {
+	baseurl := baseUrlFor(r)
+	post, err := PostByPermalink(baseurl, req.Url)
+	if err != nil || post == nil {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("%s is not a post here", req.Url))
+		return
+	}
+	if post.AccountId != account.Id {
+		writeMicropubError(w, http.StatusForbidden, "forbidden", fmt.Sprintf("%s is someone else's post", req.Url))
+		return
+	}
+
+	switch req.Action {
+	case "update":
+		micropubUpdate(w, r, req, post)
+		return
+	case "delete":
+		if !post.Deleted.Valid {
+			err = post.MarkDeleted()
+			if err == nil && post.Status == POST_PUBLISHED {
+				notifyOfDeletion(baseurl, post)
+			}
+		}
+	case "undelete":
+		if post.Deleted.Valid {
+			err = post.Restore()
+			if err == nil && post.Status == POST_PUBLISHED {
+				notifyOfPost(baseurl, post)
+			}
+		}
+	default:
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("Unknown action %s", req.Action))
+		return
+	}
+	if err != nil {
+		logr.Errln("Error performing Micropub", req.Action, "of post", post.Id, ":", err.Error())
+		writeMicropubError(w, http.StatusInternalServerError, "server_error", "error saving post to database")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func micropubSource(w http.ResponseWriter, r *http.Request, account *Account) {
+	baseurl := baseUrlFor(r)
+	post, err := PostByPermalink(baseurl, r.FormValue("url"))
+	if err != nil || post == nil || post.Deleted.Valid {
+		writeMicropubError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("%s is not a post here", r.FormValue("url")))
+		return
+	}
+	if post.AccountId != account.Id {
+		writeMicropubError(w, http.StatusForbidden, "forbidden", fmt.Sprintf("%s is someone else's post", r.FormValue("url")))
+		return
+	}
+
+	tags, err := post.Tags()
+	if err != nil {
+		logr.Errln("Error loading tags for post", post.Id, ":", err.Error())
+		// but continue
+	}
+	categories := make([]string, len(tags))
+	for i, tag := range tags {
+		categories[i] = tag.Name
+	}
+
+	postStatus := "published"
+	if post.Status == POST_DRAFT {
+		postStatus = "draft"
+	}
+	props := map[string]interface{}{
+		"content":     []interface{}{map[string]interface{}{"html": post.Html}},
+		"published":   []string{post.PostedRFC3339()},
+		"category":    categories,
+		"post-status": []string{postStatus},
+		"url":         []string{post.AbsolutePermalink(baseurl)},
+	}
+
+	r.ParseForm()
+	wanted := append(r.Form["properties"], r.Form["properties[]"]...)
+	if len(wanted) > 0 {
+		someProps := make(map[string]interface{})
+		for _, prop := range wanted {
+			if value, ok := props[prop]; ok {
+				someProps[prop] = value
+			}
+		}
+		writeMicropubJson(w, http.StatusOK, map[string]interface{}{"properties": someProps})
+		return
+	}
+
+	writeMicropubJson(w, http.StatusOK, map[string]interface{}{
+		"type":       []string{"h-entry"},
+		"properties": props,
+	})
+}
+
+func micropub(w http.ResponseWriter, r *http.Request) {
+	logr.Debugln("Yay, a Micropub request!")
+
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "GET or POST is required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == "GET" {
+		// Any posting client may ask for the config, but only reading
+		// clients may see posts' sources, as they may be drafts.
+		scope := "create"
+		if r.FormValue("q") == "source" {
+			scope = "read"
+		}
+		account := AccountAuthedFor(w, r, scope)
+		if account == nil {
+			return
+		}
+
+		switch r.FormValue("q") {
+		case "config":
+			writeMicropubJson(w, http.StatusOK, map[string]interface{}{
+				"q":            []string{"config", "source", "syndicate-to"},
+				"syndicate-to": []interface{}{},
+				"post-types":   []map[string]string{{"type": "note", "name": "Post"}},
+			})
+		case "syndicate-to":
+			writeMicropubJson(w, http.StatusOK, map[string]interface{}{
+				"syndicate-to": []interface{}{},
+			})
+		case "source":
+			micropubSource(w, r, account)
+		default:
+			writeMicropubError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("Unknown query %s", r.FormValue("q")))
+		}
+		return
+	}
+
+	var req *MicropubRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		req = new(MicropubRequest)
+		dec := json.NewDecoder(io.LimitReader(r.Body, MAX_MICROPUB_REQUEST_SIZE))
+		err := dec.Decode(req)
+		if err != nil {
+			writeMicropubError(w, http.StatusBadRequest, "invalid_request", "Could not parse JSON: "+err.Error())
+			return
+		}
+	} else {
+		err := r.ParseMultipartForm(MAX_MICROPUB_REQUEST_SIZE)
+		if err != nil && err != http.ErrNotMultipart {
+			writeMicropubError(w, http.StatusBadRequest, "invalid_request", "Could not parse form: "+err.Error())
+			return
+		}
+		req = micropubRequestFromForm(r)
+	}
+
+	scope := req.Action
+	if scope == "" {
+		scope = "create"
+	}
+	account := AccountAuthedFor(w, r, scope)
+	if account == nil {
+		return
+	}
+
+	if req.Action != "" {
+		micropubAction(w, r, req, account)
+		return
+	}
+	micropubCreate(w, r, req, account)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+const (
+	OUTBOUND_TIMEOUT           = 30 * time.Second
+	OUTBOUND_DIAL_TIMEOUT      = 10 * time.Second
+	OUTBOUND_HEADER_TIMEOUT    = 15 * time.Second
+	OUTBOUND_MAX_REDIRECTS     = 5
+	MAX_OUTBOUND_RESPONSE_SIZE = 2 << 20
+)
+
+// OUTBOUND_DENIED_NETWORKS are the addresses we won't make requests to for
+// strangers: our own machine, private and link-local networks, and other
+// addresses that aren't the public internet. That includes the IPv6
+// transition ranges (NAT64, Teredo and 6to4), which carry an IPv4 address
+// inside and could be routed to a private one.
+var OUTBOUND_DENIED_NETWORKS = mustParseNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"100::/64",
+	"2001::/32",
+	"2001:db8::/32",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// outboundAllowed are networks to allow requests to anyway, such as a
+// subscriber running on the same private network.
+var outboundAllowed []*net.IPNet
+
+func mustParseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// SetOutboundAllowlist sets the addresses and CIDR ranges we may make
+// requests to even though they're private, from a comma separated list.
+func SetOutboundAllowlist(list string) error {
+	networks, err := parseNetworks(list)
+	if err != nil {
+		return fmt.Errorf("Outbound allowlist: %s", err.Error())
+	}
+	outboundAllowed = networks
+	return nil
+}
+
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isOutboundAllowed(ip net.IP) bool {
+	if inNetworks(ip, outboundAllowed) {
+		return true
+	}
+	// Check IPv4 addresses mapped into IPv6 as the IPv4 address they are.
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return !inNetworks(ip, OUTBOUND_DENIED_NETWORKS)
+}
+
+// checkOutboundAddress refuses to connect to denied addresses. It runs as we
+// dial, after the host name is resolved, so a name can't resolve to a public
+// address when checked and a private one when used.
+func checkOutboundAddress(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("Refusing to connect to unparseable address %s", address)
+	}
+	if !isOutboundAllowed(ip) {
+		return fmt.Errorf("Refusing to connect to non-public address %s", ip)
+	}
+	return nil
+}
+
+// limitedBody is a response body that errors out once it's read past the
+// limit, rather than letting a server send us as much as it likes.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, fmt.Errorf("Response is larger than %d bytes", MAX_OUTBOUND_RESPONSE_SIZE)
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// limitedTransport caps the size of the responses its transport returns.
+type limitedTransport struct {
+	http.RoundTripper
+}
+
+func (t limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength > MAX_OUTBOUND_RESPONSE_SIZE {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Response from %s is larger than %d bytes", req.URL.Host, MAX_OUTBOUND_RESPONSE_SIZE)
+	}
+	resp.Body = &limitedBody{resp.Body, MAX_OUTBOUND_RESPONSE_SIZE}
+	return resp, nil
+}
+
+func newOutboundClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: OUTBOUND_DIAL_TIMEOUT,
+		Control: checkOutboundAddress,
+	}
+	transport := &http.Transport{
+		// Going through a proxy would mean checking the proxy's address
+		// instead of the one we're asked to reach.
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   OUTBOUND_DIAL_TIMEOUT,
+		ResponseHeaderTimeout: OUTBOUND_HEADER_TIMEOUT,
+		MaxIdleConnsPerHost:   2,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return &http.Client{
+		Transport: limitedTransport{transport},
+		Timeout:   OUTBOUND_TIMEOUT,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= OUTBOUND_MAX_REDIRECTS {
+				return fmt.Errorf("Stopped after %d redirects", OUTBOUND_MAX_REDIRECTS)
+			}
+			return nil
+		},
+	}
+}
+
+// outboundClient makes every request that strangers can point somewhere:
+// verifying and notifying subscribers, fetching and sending webmentions, and
+// fetching and delivering activities. It won't connect to private addresses
+// unless they're allowlisted, and it bounds how long requests take and how
+// much they can send back.
+var outboundClient = newOutboundClient()
@@ -32,6 +32,45 @@ func (w *Writestream) Save() error {
 	return err
 }
 
+type Revision struct {
+	Id      int64
+	PostId  int64
+	Html    string
+	Created time.Time
+}
+
+func NewRevision() (r *Revision) {
+	r = &Revision{0, 0, "", time.Now().UTC()}
+	return
+}
+
+func (r *Revision) Save() error {
+	if r.Id == 0 {
+		return db.Insert(r)
+	}
+	_, err := db.Update(r)
+	return err
+}
+
+func (r *Revision) CreatedDate() string {
+	return r.Created.Format("3:04 PM _2 Jan 2006")
+}
+
+func RevisionsForPost(postId int64) ([]*Revision, error) {
+	rows, err := db.Select(Revision{},
+		"SELECT id, postId, html, created FROM revision WHERE postId = $1 ORDER BY created DESC",
+		postId)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]*Revision, len(rows))
+	for i, row := range rows {
+		revisions[i] = row.(*Revision)
+	}
+	return revisions, nil
+}
+
 type Author struct {
 	Id   int64
 	Name string
@@ -59,18 +98,26 @@ func AuthorById(id int64) (*Author, error) {
 	return author.(*Author), nil
 }
 
+const (
+	POST_DRAFT     = "draft"
+	POST_SCHEDULED = "scheduled"
+	POST_PUBLISHED = "published"
+)
+
 type Post struct {
-	Id       int64
-	AuthorId int64
-	Url      sql.NullString
-	Html     string
-	Posted   time.Time
-	Created  time.Time
-	Deleted  pq.NullTime
+	Id        int64
+	AuthorId  int64
+	AccountId int64
+	Url       sql.NullString
+	Html      string
+	Posted    time.Time
+	Created   time.Time
+	Deleted   pq.NullTime
+	Status    string
 }
 
 func NewPost() (p *Post) {
-	p = &Post{0, 0, sql.NullString{"", false}, "", time.Now(), time.Now().UTC(), pq.NullTime{time.Unix(0, 0), false}}
+	p = &Post{0, 0, 0, sql.NullString{"", false}, "", time.Now(), time.Now().UTC(), pq.NullTime{time.Unix(0, 0), false}, POST_PUBLISHED}
 	return
 }
 
@@ -81,6 +128,16 @@ func (p *Post) Permalink() string {
 	return fmt.Sprintf("/post/%s", p.Slug())
 }
 
+// AbsolutePermalink returns the post's permalink as an absolute URL,
+// resolving it against the site's baseurl if needed.
+func (p *Post) AbsolutePermalink(baseurl string) string {
+	permalink := p.Permalink()
+	if strings.HasPrefix(permalink, "/") {
+		return baseurl + permalink
+	}
+	return permalink
+}
+
 func (p *Post) PostedTime() string {
 	return p.Posted.Format("3:04")
 }
@@ -115,6 +172,11 @@ func (p *Post) Author() (*Author, error) {
 	return AuthorById(p.AuthorId)
 }
 
+// Account returns the account whose stream the post is in.
+func (p *Post) Account() (*Account, error) {
+	return AccountById(p.AccountId)
+}
+
 func (p *Post) Slug() string {
 	var binSlug [binary.MaxVarintLen64]byte
 	n := binary.PutVarint(binSlug[0:binary.MaxVarintLen64], int64(p.Id))
@@ -129,6 +191,7 @@ func (p *Post) MarshalJSON() ([]byte, error) {
 		"Permalink":     p.Permalink(),
 		"Created":       p.Created,
 		"Posted":        p.Posted,
+		"Status":        p.Status,
 		"AuthorIsOwner": p.AuthorIsOwner(),
 	}
 
@@ -147,9 +210,14 @@ func (p *Post) MarshalJSON() ([]byte, error) {
 	return json.MarshalIndent(data, "", "    ")
 }
 
+// AuthorIsOwner reports whether the post is by the account whose stream it's
+// in, rather than being a repeat of someone else's post.
 func (p *Post) AuthorIsOwner() bool {
-	// TODO: look at the real owner of the site (somehow).
-	return p.AuthorId == 1
+	account, err := p.Account()
+	if err != nil || account == nil {
+		return false
+	}
+	return p.AuthorId == account.AuthorId
 }
 
 func (p *Post) Save() error {
@@ -165,6 +233,48 @@ func (p *Post) MarkDeleted() error {
 	return p.Save()
 }
 
+// Publish saves the post as published and puts it in the stream as of its
+// Posted time.
+func (p *Post) Publish() error {
+	p.Status = POST_PUBLISHED
+	err := p.Save()
+	if err != nil {
+		return err
+	}
+
+	ws := NewWritestream()
+	ws.PostId = p.Id
+	ws.Posted = p.Posted
+	return ws.Save()
+}
+
+func (p *Post) Restore() error {
+	p.Deleted = pq.NullTime{time.Unix(0, 0), false}
+	return p.Save()
+}
+
+func (p *Post) DeletedDate() string {
+	if !p.Deleted.Valid {
+		return ""
+	}
+	return p.Deleted.Time.Format("3:04 PM _2 Jan 2006")
+}
+
+// Revise replaces the post's HTML with html, keeping the previous HTML as a
+// Revision.
+func (p *Post) Revise(html string) error {
+	rev := NewRevision()
+	rev.PostId = p.Id
+	rev.Html = p.Html
+	err := rev.Save()
+	if err != nil {
+		return err
+	}
+
+	p.Html = html
+	return p.Save()
+}
+
 func PostById(id int64) (*Post, error) {
 	post, err := db.Get(Post{}, id)
 	if err != nil {
@@ -194,13 +304,31 @@ func PostBySlug(slug string) (*Post, error) {
 	return PostById(id)
 }
 
-func FirstPost() (*Post, error) {
+// PostByPermalink finds the post with the given absolute permalink on the
+// site at baseurl.
+func PostByPermalink(baseurl, permalink string) (*Post, error) {
+	prefix := baseurl + "/post/"
+	if !strings.HasPrefix(permalink, prefix) {
+		return nil, fmt.Errorf("%s is not a post permalink", permalink)
+	}
+	slug := permalink[len(prefix):]
+	if i := strings.IndexAny(slug, "?#"); i >= 0 {
+		slug = slug[:i]
+	}
+	return PostBySlug(slug)
+}
+
+func FirstPost(accountId int64) (*Post, error) {
 	logr.Debugln("Finding first post")
 	posts, err := db.Select(Post{},
-		"SELECT id, authorId, url, html, posted, created FROM post WHERE deleted IS NULL ORDER BY posted ASC LIMIT 1")
+		"SELECT id, authorId, accountId, url, html, posted, created, status FROM post WHERE accountId = $1 AND deleted IS NULL AND status = 'published' ORDER BY posted ASC LIMIT 1",
+		accountId)
 	if err != nil {
 		return nil, err
 	}
+	if len(posts) == 0 {
+		return nil, nil
+	}
 	post := posts[0].(*Post)
 	return post, nil
 }
@@ -213,10 +341,10 @@ func postsForRows(rows []interface{}) []*Post {
 	return posts
 }
 
-func RecentPosts(count int) ([]*Post, error) {
+func RecentPosts(accountId int64, count int) ([]*Post, error) {
 	rows, err := db.Select(Post{},
-		"SELECT p.id, p.authorId, p.url, p.html, p.posted, p.created FROM post p, writestream w WHERE p.id = w.postId AND p.deleted IS NULL ORDER BY p.posted DESC LIMIT $1",
-		count)
+		"SELECT p.id, p.authorId, p.accountId, p.url, p.html, p.posted, p.created, p.status FROM post p, writestream w WHERE p.id = w.postId AND p.accountId = $1 AND p.deleted IS NULL AND p.status = 'published' ORDER BY p.posted DESC LIMIT $2",
+		accountId, count)
 	if err != nil {
 		logr.Errln("Error querying database for", count, "posts:", err.Error())
 		return nil, err
@@ -224,27 +352,113 @@ func RecentPosts(count int) ([]*Post, error) {
 	return postsForRows(rows), nil
 }
 
-func PostsBefore(before time.Time, count int) ([]*Post, error) {
+func PostsBefore(accountId int64, before time.Time, count int) ([]*Post, error) {
 	rows, err := db.Select(Post{},
-		"SELECT p.id, p.authorId, p.url, p.html, p.posted, p.created FROM post p WHERE posted < $1 AND deleted IS NULL ORDER BY posted DESC LIMIT $2",
-		before, count)
+		"SELECT p.id, p.authorId, p.accountId, p.url, p.html, p.posted, p.created, p.status FROM post p WHERE accountId = $1 AND posted < $2 AND deleted IS NULL AND status = 'published' ORDER BY posted DESC LIMIT $3",
+		accountId, before, count)
 	if err != nil {
 		return nil, err
 	}
 	return postsForRows(rows), nil
 }
 
-func PostsOnDay(day time.Time) ([]*Post, error) {
+func PostsOnDay(accountId int64, day time.Time) ([]*Post, error) {
 	year, month, mday := day.Date()
 	minTime := time.Date(year, month, mday, 0, 0, 0, 0, time.UTC)
 	year, month, mday = day.AddDate(0, 0, 1).Date()
 	maxTime := time.Date(year, month, mday, 0, 0, 0, 0, time.UTC)
 
 	rows, err := db.Select(Post{},
-		"SELECT id, authorId, url, html, posted, created FROM post WHERE $1 <= posted AND posted < $2 AND deleted IS NULL ORDER BY posted DESC",
-		minTime, maxTime)
+		"SELECT id, authorId, accountId, url, html, posted, created, status FROM post WHERE accountId = $1 AND $2 <= posted AND posted < $3 AND deleted IS NULL AND status = 'published' ORDER BY posted DESC",
+		accountId, minTime, maxTime)
+	if err != nil {
+		return nil, err
+	}
+	return postsForRows(rows), nil
+}
+
+// UnpublishedPosts returns the scheduled posts, soonest first, followed by
+// the drafts.
+func UnpublishedPosts(accountId int64) ([]*Post, error) {
+	rows, err := db.Select(Post{},
+		"SELECT id, authorId, accountId, url, html, posted, created, status FROM post WHERE accountId = $1 AND deleted IS NULL AND status != 'published' ORDER BY status DESC, posted ASC",
+		accountId)
 	if err != nil {
 		return nil, err
 	}
 	return postsForRows(rows), nil
 }
+
+func ScheduledPostsDue(now time.Time) ([]*Post, error) {
+	rows, err := db.Select(Post{},
+		"SELECT id, authorId, accountId, url, html, posted, created, status FROM post WHERE deleted IS NULL AND status = 'scheduled' AND posted <= $1 ORDER BY posted ASC",
+		now)
+	if err != nil {
+		return nil, err
+	}
+	return postsForRows(rows), nil
+}
+
+func DeletedPosts(accountId int64) ([]*Post, error) {
+	rows, err := db.Select(Post{},
+		"SELECT id, authorId, accountId, url, html, posted, created, deleted, status FROM post WHERE accountId = $1 AND deleted IS NOT NULL ORDER BY deleted DESC",
+		accountId)
+	if err != nil {
+		return nil, err
+	}
+	return postsForRows(rows), nil
+}
+
+// PurgeDeletedBefore permanently removes the posts that were marked deleted
+// before the given time, along with the records that refer to them. It
+// returns the number of posts removed.
+func PurgeDeletedBefore(before time.Time) (int64, error) {
+	trans, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	deletedIds := "SELECT id FROM post WHERE deleted < $1"
+	statements := []string{
+		"DELETE FROM writestream WHERE postId IN (" + deletedIds + ")",
+		"DELETE FROM revision WHERE postId IN (" + deletedIds + ")",
+		"DELETE FROM tag WHERE postId IN (" + deletedIds + ")",
+		"DELETE FROM webmention WHERE postId IN (" + deletedIds + ")",
+		// Only twitter imports refer to posts; twitterAuthor imports are authors.
+		"DELETE FROM import WHERE source = 'twitter' AND value IN (" + deletedIds + ")",
+	}
+	for _, statement := range statements {
+		_, err = trans.Exec(statement, before)
+		if err != nil {
+			trans.Rollback()
+			return 0, err
+		}
+	}
+
+	result, err := trans.Exec("DELETE FROM post WHERE deleted < $1", before)
+	if err != nil {
+		trans.Rollback()
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		trans.Rollback()
+		return 0, err
+	}
+
+	err = trans.Commit()
+	return count, err
+}
+
+func PurgeDeleted(age time.Duration) {
+	before := time.Now().UTC().Add(-age)
+	logr.Debugln("Purging posts deleted before", before)
+
+	count, err := PurgeDeletedBefore(before)
+	if err != nil {
+		logr.Errln("Error purging deleted posts:", err.Error())
+		return
+	}
+
+	logr.Debugln("Purged", count, "deleted posts")
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// siteBaseUrl is the configured canonical URL of the site. It's also how we
+// know where we are when there's no request to tell us.
+var siteBaseUrl string
+
+// trustedProxies are the networks of the reverse proxies in front of us,
+// whose Forwarded and X-Forwarded-* headers we believe.
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets which proxies to trust from a comma separated list
+// of addresses and CIDR ranges, such as "127.0.0.1,10.0.0.0/8".
+func SetTrustedProxies(list string) error {
+	networks, err := parseNetworks(list)
+	if err != nil {
+		return fmt.Errorf("Trusted proxies: %s", err.Error())
+	}
+	trustedProxies = networks
+	return nil
+}
+
+// parseNetworks parses a comma separated list of IP addresses and CIDR
+// ranges.
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		cidr := addr
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("%s is not an IP address or CIDR range", addr)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			cidr = fmt.Sprintf("%s/%d", cidr, bits)
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not an IP address or CIDR range", addr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripPort returns the host part of a host with an optional port, as proxies
+// may give addresses either way.
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// forwardedElements parses the request's RFC 7239 Forwarded headers into
+// their elements, one per proxy, nearest the client first.
+func forwardedElements(r *http.Request) []map[string]string {
+	var elements []map[string]string
+	for _, header := range r.Header["Forwarded"] {
+		for _, elementText := range strings.Split(header, ",") {
+			element := make(map[string]string)
+			for _, pair := range strings.Split(elementText, ";") {
+				parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(parts) < 2 {
+					continue
+				}
+				element[strings.ToLower(parts[0])] = strings.Trim(parts[1], `"`)
+			}
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+// lastHeaderValue returns the last of the comma separated values of the
+// header, which is the one the nearest proxy added.
+func lastHeaderValue(r *http.Request, name string) string {
+	values := strings.Split(r.Header.Get(name), ",")
+	return strings.TrimSpace(values[len(values)-1])
+}
+
+func fromTrustedProxy(r *http.Request) bool {
+	return len(trustedProxies) > 0 && isTrustedProxy(stripPort(r.RemoteAddr))
+}
+
+// clientAddr returns the address of the client that made the request. If the
+// request came through our trusted proxies, that's the nearest address they
+// say forwarded it that isn't one of them.
+func clientAddr(r *http.Request) string {
+	addr := stripPort(r.RemoteAddr)
+	if !fromTrustedProxy(r) {
+		return addr
+	}
+
+	var hops []string
+	if elements := forwardedElements(r); len(elements) > 0 {
+		for _, element := range elements {
+			hops = append(hops, element["for"])
+		}
+	} else if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		hops = strings.Split(forwardedFor, ",")
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := stripPort(strings.TrimSpace(hops[i]))
+		if hop == "" {
+			break
+		}
+		addr = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// requestScheme returns whether the client asked for the request over http
+// or https.
+func requestScheme(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if !fromTrustedProxy(r) {
+		return scheme
+	}
+
+	proto := ""
+	if elements := forwardedElements(r); len(elements) > 0 {
+		proto = elements[len(elements)-1]["proto"]
+	} else {
+		proto = lastHeaderValue(r, "X-Forwarded-Proto")
+	}
+	proto = strings.ToLower(proto)
+	if proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme
+}
+
+// requestHost returns the host (and port, if any) the client asked for.
+func requestHost(r *http.Request) string {
+	if !fromTrustedProxy(r) {
+		return r.Host
+	}
+
+	host := ""
+	if elements := forwardedElements(r); len(elements) > 0 {
+		host = elements[len(elements)-1]["host"]
+	} else {
+		host = lastHeaderValue(r, "X-Forwarded-Host")
+	}
+	if host == "" || strings.ContainsAny(host, "/\\@ ") {
+		return r.Host
+	}
+	return host
+}
+
+// baseUrlFor returns the URL of the root of the site, without the trailing
+// slash. That's the configured --base-url if there is one, as otherwise
+// clients could pick it with the Host header.
+func baseUrlFor(r *http.Request) string {
+	if siteBaseUrl != "" {
+		return strings.TrimRight(siteBaseUrl, "/")
+	}
+
+	baseurlUrl := url.URL{Scheme: requestScheme(r), Host: requestHost(r), Path: "/"}
+	return strings.TrimRight(baseurlUrl.String(), "/")
+}
+
+// siteHostPort returns the host name and port of the site's base URL.
+func siteHostPort(baseurl string) (host, port string, err error) {
+	baseurlUrl, err := url.Parse(baseurl)
+	if err != nil {
+		return "", "", err
+	}
+	host, port = baseurlUrl.Hostname(), baseurlUrl.Port()
+	if port == "" {
+		port = "80"
+		if baseurlUrl.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return host, port, nil
+}
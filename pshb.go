@@ -4,10 +4,16 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"github.com/bmizerany/pq"
+	"hash"
 	//"github.com/moovweb/gokogiri/xml"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -16,40 +22,214 @@ import (
 	"time"
 )
 
-type Subscription struct {
-	Id         uint64
-	Url        string
-	LeaseUntil time.Time
-	Secret     sql.NullString
-	Created    time.Time
+const (
+	HUB_DEFAULT_LEASE  = 10 * 24 * time.Hour
+	HUB_MIN_LEASE      = time.Hour
+	HUB_MAX_LEASE      = 30 * 24 * time.Hour
+	MAX_HUB_SECRET_LEN = 200
+	// MAX_CHALLENGE_RESPONSE_SIZE is how much of a verification response
+	// we read; anything longer can't be just our challenge anyway.
+	MAX_CHALLENGE_RESPONSE_SIZE = 1024
+)
+
+// HUB_SIGNATURE_METHODS are the hashes we can sign notifications with.
+var HUB_SIGNATURE_METHODS = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
 }
 
-func (s *Subscription) Notify(feed string) {
-	// Don't notify if the subscription expired.
-	if s.LeaseUntil.Before(time.Now().UTC()) {
-		return
+// hubSignatureMethod is the hash we sign notifications with, for subscribers
+// that gave a secret.
+var hubSignatureMethod = "sha256"
+
+// hubSignature returns the X-Hub-Signature header value for the content
+// signed with the secret.
+func hubSignature(secret, content string) string {
+	sign := hmac.New(HUB_SIGNATURE_METHODS[hubSignatureMethod], []byte(secret))
+	sign.Write([]byte(content))
+	return fmt.Sprintf("%s=%s", hubSignatureMethod, hex.EncodeToString(sign.Sum(nil)))
+}
+
+// hubUrl returns the URL of our hub, for advertising on the feeds it serves.
+func hubUrl(baseurl string) string {
+	return baseurl + "/hub"
+}
+
+// FeedTopic is a feed subscribers can follow through the hub: one of an
+// account's feeds, or the archive feed for one of its days.
+type FeedTopic struct {
+	Account *Account
+	Feed    string
+	Day     time.Time
+}
+
+// FEED_TOPIC_TYPES are the feeds we serve as hub topics, by their path in an
+// account's stream, and the content types they're delivered as. Archive feeds
+// are RSS.
+var FEED_TOPIC_TYPES = map[string]string{
+	"/atom":      "application/atom+xml",
+	"/rss":       "application/rss+xml",
+	"/activity":  "application/json",
+	"/feed.json": "application/feed+json",
+	"/archive":   "application/rss+xml",
+}
+
+// ParseFeedTopic finds the feed the topic URL is for, returning nil if it's
+// not a feed on this site.
+func ParseFeedTopic(baseurl, topic string) (*FeedTopic, error) {
+	if !strings.HasPrefix(topic, baseurl+"/") {
+		return nil, nil
+	}
+	path := topic[len(baseurl):]
+
+	account := AccountForOwner()
+	if strings.HasPrefix(path, "/~") {
+		name := path[len("/~"):]
+		slash := strings.Index(name, "/")
+		if slash < 0 {
+			return nil, nil
+		}
+		name, path = name[:slash], name[slash:]
+
+		var err error
+		account, err = AccountByName(name)
+		if err != nil {
+			return nil, err
+		}
+		// The owner's feeds are only at the root.
+		if account == nil || account.IsOwner() {
+			return nil, nil
+		}
+	}
+	if account == nil {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(path, "/archive/") {
+		day, err := time.Parse("/archive/2006/01/02/rss.xml", path)
+		if err != nil {
+			return nil, nil
+		}
+		return &FeedTopic{account, "/archive", day}, nil
+	}
+	if _, ok := FEED_TOPIC_TYPES[path]; !ok || path == "/archive" {
+		return nil, nil
+	}
+	return &FeedTopic{account, path, time.Time{}}, nil
+}
+
+// TopicsForPost returns the feeds the post appears in.
+func TopicsForPost(account *Account, post *Post) []*FeedTopic {
+	day := post.Posted.UTC()
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	return []*FeedTopic{
+		&FeedTopic{account, "/atom", time.Time{}},
+		&FeedTopic{account, "/rss", time.Time{}},
+		&FeedTopic{account, "/activity", time.Time{}},
+		&FeedTopic{account, "/feed.json", time.Time{}},
+		&FeedTopic{account, "/archive", day},
+	}
+}
+
+// Path returns the path of the topic's feed, relative to the root of the
+// site. Subscriptions are stored by this path, so they follow the site if
+// its base URL changes.
+func (t *FeedTopic) Path() string {
+	if t.Feed == "/archive" {
+		return t.Account.Path() + archivePath(t.Day)
 	}
+	return t.Account.Path() + t.Feed
+}
+
+func (t *FeedTopic) ContentType() string {
+	return FEED_TOPIC_TYPES[t.Feed]
+}
+
+// Render renders the topic's feed with the given posts.
+func (t *FeedTopic) Render(baseurl string, posts []*Post) (string, error) {
+	switch t.Feed {
+	case "/atom":
+		return AtomForPosts(baseurl, t.Account, posts, "%s"), nil
+	case "/rss":
+		return RssForPosts(baseurl, t.Account, posts, "%s")
+	case "/activity":
+		content, err := ActivityStreamForPosts(baseurl, t.Account, posts)
+		return string(content), err
+	case "/feed.json":
+		content, err := JsonFeedForPosts(baseurl, t.Account, posts)
+		return string(content), err
+	case "/archive":
+		return RssForPosts(baseurl, t.Account, posts, archiveTitleFormat(t.Day))
+	}
+	return "", fmt.Errorf("Unknown feed topic %s", t.Feed)
+}
+
+// Content renders the topic's feed to notify subscribers of the new post.
+// Archive feeds have all the day's posts, like they do when fetched; the
+// others have only the new one.
+func (t *FeedTopic) Content(baseurl string, post *Post) (string, error) {
+	if t.Feed == "/archive" {
+		return t.CurrentContent(baseurl)
+	}
+	return t.Render(baseurl, []*Post{post})
+}
+
+// CurrentContent renders the topic's feed as it is now.
+func (t *FeedTopic) CurrentContent(baseurl string) (string, error) {
+	var posts []*Post
+	var err error
+	if t.Feed == "/archive" {
+		posts, err = PostsOnDay(t.Account.Id, t.Day)
+	} else {
+		posts, err = RecentPosts(t.Account.Id, 20)
+	}
+	if err != nil {
+		return "", err
+	}
+	return t.Render(baseurl, posts)
+}
 
-	buf := bytes.NewBufferString(feed)
+type Subscription struct {
+	Id            uint64
+	Url           string
+	Topic         string
+	LeaseUntil    time.Time
+	Secret        sql.NullString
+	Created       time.Time
+	LastStatus    sql.NullString
+	LastAttempted pq.NullTime
+	LastDelivered pq.NullTime
+	// Failures is how many deliveries in a row the subscriber didn't take.
+	Failures int
+}
+
+// Deliver POSTs the delivery's feed to the subscriber, returning whether they
+// took it and the status to record for the attempt.
+func (s *Subscription) Deliver(d *Delivery) (bool, string) {
+	buf := bytes.NewBufferString(d.Body)
 	req, err := http.NewRequest("POST", s.Url, buf)
 	if err != nil {
-		// ...?!?
 		logr.Errln("Error creating new HTTP request to notify subscriber:", err.Error())
-		return
+		return false, err.Error()
+	}
+	req.Header.Set("Content-Type", d.ContentType)
+	if d.TopicUrl != "" {
+		req.Header.Add("Link", fmt.Sprintf(`<%s>; rel="hub"`, d.HubUrl))
+		req.Header.Add("Link", fmt.Sprintf(`<%s>; rel="self"`, d.TopicUrl))
 	}
-	req.Header.Set("Content-Type", "application/atom+xml")
 	if s.Secret.Valid {
-		sign := hmac.New(sha1.New, []byte(s.Secret.String))
-		sign.Write([]byte(feed))
-		hashData := make([]byte, 40, 0) // actually too long, it's 40 hex chars
-		hash := sign.Sum(hashData)
-
-		signature := fmt.Sprintf("sha1=%s", hex.EncodeToString(hash))
-		req.Header.Set("X-Hub-Signature", signature)
+		req.Header.Set("X-Hub-Signature", hubSignature(s.Secret.String, d.Body))
 	}
 
-	resp, _ := http.DefaultClient.Do(req)
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return false, err.Error()
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, MAX_DELIVERY_RESPONSE_SIZE))
 	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300, resp.Status
 }
 
 func (s *Subscription) Save() error {
@@ -60,10 +240,34 @@ func (s *Subscription) Save() error {
 	return err
 }
 
-func ActiveSubscriptions() ([]*Subscription, error) {
+// Delete removes the subscription, along with any notifications still queued
+// for it.
+func (s *Subscription) Delete() error {
+	_, err := db.Delete(s)
+	return err
+}
+
+// RecordAttempt notes how delivering to the subscriber went.
+func (s *Subscription) RecordAttempt(ok bool, status string) {
+	now := time.Now().UTC()
+	s.LastStatus = sql.NullString{status, true}
+	s.LastAttempted.Time, s.LastAttempted.Valid = now, true
+	if ok {
+		s.LastDelivered.Time, s.LastDelivered.Valid = now, true
+		s.Failures = 0
+	} else {
+		s.Failures++
+	}
+}
+
+func (s *Subscription) IsExpired() bool {
+	return s.LeaseUntil.Before(time.Now())
+}
+
+func ActiveSubscriptionsForTopic(topic string) ([]*Subscription, error) {
 	rows, err := db.Select(Subscription{},
-		"SELECT id, url, leaseuntil, secret, created FROM subscription WHERE leaseuntil > $1",
-		time.Now().UTC())
+		"SELECT id, url, topic, leaseuntil, secret, created, lastStatus, lastAttempted, lastDelivered, failures FROM subscription WHERE topic = $1 AND leaseuntil > $2",
+		topic, time.Now().UTC())
 	if err != nil {
 		return nil, err
 	}
@@ -75,25 +279,98 @@ func ActiveSubscriptions() ([]*Subscription, error) {
 	return clouds, nil
 }
 
-func NotifySubscribers(feed string) {
-	logr.Debugln("Sending PubSubHubbub notifications")
+// AllSubscriptions returns every subscription, including expired ones,
+// soonest to expire first.
+func AllSubscriptions() ([]*Subscription, error) {
+	rows, err := db.Select(Subscription{},
+		"SELECT id, url, topic, leaseuntil, secret, created, lastStatus, lastAttempted, lastDelivered, failures FROM subscription ORDER BY leaseuntil, id")
+	if err != nil {
+		return nil, err
+	}
+
+	subs := make([]*Subscription, len(rows))
+	for i, row := range rows {
+		subs[i] = row.(*Subscription)
+	}
+	return subs, nil
+}
 
-	subs, err := ActiveSubscriptions()
+// DeleteExpiredSubscriptions removes the subscriptions whose leases ran out,
+// along with any notifications still queued for them, returning how many
+// there were.
+func DeleteExpiredSubscriptions() (int64, error) {
+	result, err := db.Exec("DELETE FROM subscription WHERE leaseuntil <= $1", time.Now().UTC())
 	if err != nil {
-		logr.Errln("Error finding pubsubhubbub subscribers:", err.Error())
-		return
+		return 0, err
 	}
+	return result.RowsAffected()
+}
 
-	for _, sub := range subs {
-		go sub.Notify(feed)
+func SubscriptionByUrl(callback, topic string) (*Subscription, error) {
+	rows, err := db.Select(Subscription{},
+		"SELECT id, url, topic, leaseuntil, secret, created, lastStatus, lastAttempted, lastDelivered, failures FROM subscription WHERE url = $1 AND topic = $2",
+		callback, topic)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].(*Subscription), nil
+}
+
+func DeleteSubscriptionByUrl(callback, topic string) error {
+	_, err := db.Exec("DELETE FROM subscription WHERE url = $1 AND topic = $2", callback, topic)
+	return err
+}
+
+func SubscriptionById(id uint64) (*Subscription, error) {
+	rows, err := db.Select(Subscription{},
+		"SELECT id, url, topic, leaseuntil, secret, created, lastStatus, lastAttempted, lastDelivered, failures FROM subscription WHERE id = $1",
+		id)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].(*Subscription), nil
+}
+
+// NotifySubscribers queues the new post for delivery to the hub's subscribers
+// to each of the account's feeds it appears in.
+func NotifySubscribers(baseurl string, account *Account, post *Post) {
+	logr.Debugln("Queueing PubSubHubbub notifications")
+
+	for _, topic := range TopicsForPost(account, post) {
+		path := topic.Path()
+		subs, err := ActiveSubscriptionsForTopic(path)
+		if err != nil {
+			logr.Errln("Error finding pubsubhubbub subscribers to", path, ":", err.Error())
+			continue
+		}
+		if len(subs) == 0 {
+			continue
+		}
+
+		feed, err := topic.Content(baseurl, post)
+		if err != nil {
+			logr.Errln("Error rendering", path, "for pubsubhubbub notifications:", err.Error())
+			continue
+		}
+		err = QueueDeliveries(subs, hubUrl(baseurl), baseurl+path, topic.ContentType(), feed)
+		if err != nil {
+			logr.Errln("Error queueing pubsubhubbub notifications for", path, ":", err.Error())
+		}
 	}
 }
 
 type SubscribeRequest struct {
 	Mode        string
 	Topic       string
+	TopicPath   string
 	CallbackUrl *url.URL
-	LeaseUntil  time.Time
+	Lease       time.Duration
 	Secret      string
 	VerifyToken string
 }
@@ -104,17 +381,20 @@ func (u UnverifiedResponse) Error() string {
 	return string(u)
 }
 
+// Verify checks with the subscriber that they asked for the request, by
+// sending them a random challenge they must echo back, then does it.
 func (req *SubscribeRequest) Verify() error {
-	challenge := "yup"
+	challenge, err := RandomToken(24)
+	if err != nil {
+		return err
+	}
 
 	query := req.CallbackUrl.Query()
 	query.Set("hub.mode", req.Mode)
 	query.Set("hub.topic", req.Topic)
 	query.Set("hub.challenge", challenge)
 	if req.Mode == "subscribe" {
-		leaseDuration := req.LeaseUntil.Sub(time.Now().UTC())
-		leaseSecondsStr := strconv.Itoa(int(leaseDuration / time.Second))
-		query.Set("hub.lease_seconds", leaseSecondsStr)
+		query.Set("hub.lease_seconds", strconv.Itoa(int(req.Lease/time.Second)))
 	}
 	if req.VerifyToken != "" {
 		query.Set("hub.verify_token", req.VerifyToken)
@@ -123,30 +403,55 @@ func (req *SubscribeRequest) Verify() error {
 	verifyUrl := *req.CallbackUrl // verifyUrl is not a pointer
 	verifyUrl.RawQuery = query.Encode()
 
-	resp, err := http.Get(verifyUrl.String())
+	resp, err := outboundClient.Get(verifyUrl.String())
 	if err != nil {
-		return fmt.Errorf("Unexpected HTTP error verifying request")
+		return fmt.Errorf("Unexpected HTTP error verifying request: %s", err.Error())
 	}
-
-	// Ideally we would search progressively, such as by using
-	// regexp.MatchReader(RuneReadifier(resp.Body))... but we'd have to
-	// implement RuneReadifier.
-	body, err := ioutil.ReadAll(resp.Body)
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return UnverifiedResponse(fmt.Sprintf("Callback responded to verification with %s", resp.Status))
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_CHALLENGE_RESPONSE_SIZE))
 	if err != nil {
 		return err
 	}
-	if !bytes.Contains(body, []byte(challenge)) {
-		return UnverifiedResponse("Response body did not contain the verification token")
+	if subtle.ConstantTimeCompare(body, []byte(challenge)) != 1 {
+		return UnverifiedResponse("Response body was not the verification challenge")
 	}
 
-	subSecret := sql.NullString{req.Secret, req.Secret != ""}
-	sub := &Subscription{0, req.CallbackUrl.String(), req.LeaseUntil, subSecret, time.Now().UTC()}
-	err = db.Insert(sub)
+	callback := req.CallbackUrl.String()
+	if req.Mode == "unsubscribe" {
+		logr.Debugln("Unsubscribing", callback, "from", req.TopicPath)
+		return DeleteSubscriptionByUrl(callback, req.TopicPath)
+	}
+
+	sub, err := SubscriptionByUrl(callback, req.TopicPath)
 	if err != nil {
 		return err
 	}
+	if sub == nil {
+		sub = &Subscription{0, callback, req.TopicPath, time.Now(), sql.NullString{"", false}, time.Now().UTC(),
+			sql.NullString{"", false}, pq.NullTime{time.Unix(0, 0), false}, pq.NullTime{time.Unix(0, 0), false}, 0}
+	} else {
+		logr.Debugln("Renewing subscription", sub.Id, "for", callback)
+	}
+	// Resubscribing renews the lease and replaces the secret.
+	sub.LeaseUntil = time.Now().UTC().Add(req.Lease)
+	sub.Secret = sql.NullString{req.Secret, req.Secret != ""}
+	return sub.Save()
+}
 
-	return nil
+// clampLease returns the lease to grant for the subscriber's requested lease
+// seconds, within our limits.
+func clampLease(leaseSeconds int) time.Duration {
+	lease := time.Duration(leaseSeconds) * time.Second
+	if lease < HUB_MIN_LEASE {
+		return HUB_MIN_LEASE
+	}
+	if lease > HUB_MAX_LEASE {
+		return HUB_MAX_LEASE
+	}
+	return lease
 }
 
 func hub(w http.ResponseWriter, r *http.Request) {
@@ -157,31 +462,50 @@ func hub(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "POST is required", http.StatusMethodNotAllowed)
 		return
 	}
+	r.ParseForm()
+
+	mode := r.PostFormValue("hub.mode")
+	if mode != "subscribe" && mode != "unsubscribe" {
+		logr.Debugln("Subscriber asked for mode", mode, "so did nothing")
+		http.Error(w, fmt.Sprintf("Unsupported hub.mode %s", mode), http.StatusBadRequest)
+		return
+	}
 
-	verifyModes := r.Form["hub.verify"]
-	canVerifySync, canVerifyAsync := false, false
-	for _, verifyMode := range verifyModes {
-		if verifyMode == "sync" {
-			canVerifySync = true
-		} else if verifyMode == "async" {
-			canVerifyAsync = true
+	// WebSub hubs always verify asynchronously, but older PubSubHubbub
+	// subscribers may ask to be verified synchronously instead.
+	verifyModes := r.PostForm["hub.verify"]
+	verifySync := false
+	if len(verifyModes) > 0 {
+		canVerifySync, canVerifyAsync := false, false
+		for _, verifyMode := range verifyModes {
+			if verifyMode == "sync" {
+				canVerifySync = true
+			} else if verifyMode == "async" {
+				canVerifyAsync = true
+			}
+		}
+		if !canVerifyAsync && !canVerifySync {
+			logr.Debugln("Subscriber asked for verification modes", verifyModes, "so couldn't subscribe them")
+			http.Error(w, fmt.Sprintf("None of your requested verification modes (%s) are supported", strings.Join(verifyModes, ",")), http.StatusBadRequest)
+			return
 		}
+		verifySync = !canVerifyAsync
 	}
-	if !canVerifyAsync && !canVerifySync {
-		logr.Debugln("Subscriber asked for verification modes", verifyModes, "so couldn't subscribe them")
-		http.Error(w, fmt.Sprintf("None of your requested verification modes (%s) are supported", strings.Join(verifyModes, ",")), http.StatusBadRequest)
+
+	topic := r.PostFormValue("hub.topic")
+	feedTopic, err := ParseFeedTopic(baseUrlFor(r), topic)
+	if err != nil {
+		logr.Errln("Error finding feed for subscription topic", topic, ":", err.Error())
+		http.Error(w, "error finding subscription topic", http.StatusInternalServerError)
 		return
 	}
-
-	topic := r.FormValue("hub.topic")
-	// TODO: ssl?
-	if topic != fmt.Sprintf("http://%s/atom", r.Host) {
+	if feedTopic == nil {
 		logr.Debugln("Subscriber asked for a subscription to", topic, "so couldn't subscribe them")
 		http.Error(w, fmt.Sprintf("Your requested subscription topic %s is not tracked by this hub", topic), http.StatusBadRequest)
 		return
 	}
 
-	callback := r.FormValue("hub.callback")
+	callback := r.PostFormValue("hub.callback")
 	callbackUrl, err := url.Parse(callback)
 	if err != nil {
 		logr.Debugln("Subscriber asked for a subscription with callback", callback, "which doesn't parse as an url:", err.Error())
@@ -199,8 +523,8 @@ func hub(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	leaseUntil := time.Now().UTC()
-	leaseSecondsStr := r.FormValue("hub.lease_seconds")
+	lease := HUB_DEFAULT_LEASE
+	leaseSecondsStr := r.PostFormValue("hub.lease_seconds")
 	if leaseSecondsStr != "" {
 		leaseSeconds, err := strconv.Atoi(leaseSecondsStr)
 		if err != nil {
@@ -208,22 +532,32 @@ func hub(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, fmt.Sprintf("Could not parse your requested lease seconds (%s)", leaseSecondsStr), http.StatusBadRequest)
 			return
 		}
-		leaseUntil = leaseUntil.Add(time.Duration(leaseSeconds) * time.Second)
-	} else {
-		leaseUntil = leaseUntil.AddDate(0, 1, 0) // one month
+		lease = clampLease(leaseSeconds)
+	}
+
+	secret := r.PostFormValue("hub.secret")
+	if len(secret) >= MAX_HUB_SECRET_LEN {
+		http.Error(w, fmt.Sprintf("Your hub.secret must be shorter than %d bytes", MAX_HUB_SECRET_LEN), http.StatusBadRequest)
+		return
 	}
 
 	req := &SubscribeRequest{
-		r.FormValue("hub.mode"),
+		mode,
 		topic,
+		feedTopic.Path(),
 		callbackUrl,
-		leaseUntil,
-		r.FormValue("hub.secret"),
-		r.FormValue("hub.verify_token"),
+		lease,
+		secret,
+		r.PostFormValue("hub.verify_token"),
 	}
 
-	if canVerifyAsync {
-		go req.Verify()
+	if !verifySync {
+		inBackground(func() {
+			err := req.Verify()
+			if err != nil {
+				logr.Debugln("Couldn't verify", req.Mode, "request for", callback, ":", err.Error())
+			}
+		})
 		w.WriteHeader(http.StatusAccepted)
 		return
 	}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"database/sql"
 	"fmt"
+	"github.com/bmizerany/pq"
 	"github.com/moovweb/gokogiri"
 	"github.com/moovweb/gokogiri/xml"
+	"html"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
@@ -14,14 +19,28 @@ import (
 	"time"
 )
 
+const (
+	RSSCLOUD_XML_RPC    = "xml-rpc"
+	RSSCLOUD_HTTP_POST  = "http-post"
+	RSSCLOUD_HTTPS_POST = "https-post"
+
+	// RSSCLOUD_LEASE is how long an rssCloud subscription lasts before the
+	// subscriber must ask again.
+	RSSCLOUD_LEASE = 25 * time.Hour
+	// RSSCLOUD_MAX_FAILURES is how many notifications in a row a subscriber
+	// can fail to take before we unsubscribe them.
+	RSSCLOUD_MAX_FAILURES = 5
+)
+
 type RssCloudRequest struct {
 	RequestMethodName string
 	MethodName        string
 	Host              string
 	Port              uint16
 	Path              string
-	IsXmlRpc          bool
-	FeedURL           string
+	Protocol          string
+	Domain            string
+	FeedURLs          []string
 }
 
 func (r *RssCloudRequest) Unpack(doc *xml.XmlDocument) error {
@@ -41,7 +60,7 @@ func (r *RssCloudRequest) Unpack(doc *xml.XmlDocument) error {
 	if err != nil {
 		return err
 	}
-	if len(params) != 5 {
+	if len(params) != 5 && len(params) != 6 {
 		return fmt.Errorf("Could not unpack cloud request with %d params", len(params))
 	}
 
@@ -78,7 +97,7 @@ func (r *RssCloudRequest) Unpack(doc *xml.XmlDocument) error {
 	if node.NodeType() != xml.XML_TEXT_NODE {
 		return fmt.Errorf("Could not unpack cloud request with fourth param not text")
 	}
-	r.IsXmlRpc = strings.TrimSpace(node.Content()) == "xml-rpc"
+	r.Protocol = strings.TrimSpace(node.Content())
 
 	node = params[4].FirstChild()
 	if node.NodeType() != xml.XML_ELEMENT_NODE {
@@ -87,32 +106,220 @@ func (r *RssCloudRequest) Unpack(doc *xml.XmlDocument) error {
 	if node.Name() != "array" {
 		return fmt.Errorf("Could not unpack cloud request with fifth param a %s element, not array", node.Name())
 	}
-	params, err = node.Search("data/value/text()")
+	urls, err := node.Search("data/value/text()")
 	if err != nil {
 		return err
 	}
-	if len(params) < 1 {
+	if len(urls) < 1 {
 		return fmt.Errorf("Could not unpack cloud request with fifth param containing no data values")
 	}
-	r.FeedURL = params[0].Content()
+	for _, feedurl := range urls {
+		r.FeedURLs = append(r.FeedURLs, feedurl.Content())
+	}
+
+	// The domain is optional, and may or may not be in a string element.
+	if len(params) == 6 {
+		r.Domain = strings.TrimSpace(params[5].Content())
+		if !isBareHostName(r.Domain) {
+			return fmt.Errorf("Could not unpack cloud request with domain %q, which isn't a host name", r.Domain)
+		}
+	}
 
 	logr.Debugln("Unpacked cloud request!")
 	return nil
 }
 
+// UnpackForm reads a REST pleaseNotify request: the callback's port, path and
+// protocol, an optional domain, and the feeds as url1, url2 and so on.
+func (r *RssCloudRequest) UnpackForm(form url.Values) error {
+	r.RequestMethodName = "pleaseNotify"
+	r.MethodName = form.Get("notifyProcedure")
+
+	port, err := strconv.ParseUint(form.Get("port"), 10, 16)
+	if err != nil {
+		return fmt.Errorf("Could not parse cloud request port %s", form.Get("port"))
+	}
+	r.Port = uint16(port)
+	r.Path = form.Get("path")
+	r.Protocol = form.Get("protocol")
+	r.Domain = strings.TrimSpace(form.Get("domain"))
+	if !isBareHostName(r.Domain) {
+		return fmt.Errorf("Could not unpack cloud request with domain %q, which isn't a host name", r.Domain)
+	}
+
+	for i := 1; ; i++ {
+		feedurl := form.Get(fmt.Sprintf("url%d", i))
+		if feedurl == "" {
+			break
+		}
+		r.FeedURLs = append(r.FeedURLs, feedurl)
+	}
+	if len(r.FeedURLs) < 1 {
+		return fmt.Errorf("Could not unpack cloud request with no url1 parameter")
+	}
+	return nil
+}
+
+// isBareHostName checks the domain a subscriber gave is only a host name or
+// IP address, with no port, path or user info to change where we'd call.
+// The empty domain is fine, as it's optional.
+func isBareHostName(domain string) bool {
+	if domain == "" || net.ParseIP(domain) != nil {
+		return true
+	}
+	if len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// CallbackUrl returns the URL to notify the subscriber at: on the domain they
+// named, or otherwise the address they asked from.
+func (r *RssCloudRequest) CallbackUrl() string {
+	callback := &url.URL{Scheme: "http", Path: r.Path}
+	if r.Protocol == RSSCLOUD_HTTPS_POST || r.Port == 443 {
+		callback.Scheme = "https"
+	}
+	host := r.Host
+	if r.Domain != "" {
+		host = r.Domain
+	}
+	if (callback.Scheme == "http" && r.Port == 80) || (callback.Scheme == "https" && r.Port == 443) {
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		callback.Host = host
+	} else {
+		callback.Host = net.JoinHostPort(host, strconv.Itoa(int(r.Port)))
+	}
+	if !strings.HasPrefix(callback.Path, "/") {
+		callback.Path = "/" + callback.Path
+	}
+	return callback.String()
+}
+
+// Verify checks the subscriber wants notifications at their callback. If they
+// take notifications over HTTP and named a domain, we ask it to echo back a
+// challenge, so no one can sign up someone else's site; otherwise we send them
+// a notification, which must succeed. XML-RPC subscribers have no way to
+// answer a challenge, so they always get a notification.
+func (r *RssCloudRequest) Verify(cloud *RssCloud, feedurl string) error {
+	if r.Domain == "" || r.Protocol == RSSCLOUD_XML_RPC {
+		return cloud.Notify(feedurl)
+	}
+
+	challenge, err := RandomToken(24)
+	if err != nil {
+		return err
+	}
+	verifyUrl, err := url.Parse(cloud.URL)
+	if err != nil {
+		return err
+	}
+	query := verifyUrl.Query()
+	query.Set("url", feedurl)
+	query.Set("challenge", challenge)
+	verifyUrl.RawQuery = query.Encode()
+
+	resp, err := outboundClient.Get(verifyUrl.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Callback responded to verification with %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_CHALLENGE_RESPONSE_SIZE))
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(bytes.TrimSpace(body), []byte(challenge)) != 1 {
+		return fmt.Errorf("Callback did not respond with the verification challenge")
+	}
+	return nil
+}
+
 type RssCloud struct {
 	Id              uint64
 	URL             string
 	Method          string
+	Protocol        string
 	SubscribedUntil time.Time
 	Created         time.Time
+	LastStatus      sql.NullString
+	LastAttempted   pq.NullTime
+	// Failures is how many notifications in a row the subscriber didn't take.
+	Failures int
 }
 
 func NewRssCloud() *RssCloud {
-	return &RssCloud{0, "", "", time.Unix(0, 0), time.Now().UTC()}
+	return &RssCloud{0, "", "", RSSCLOUD_XML_RPC, time.Unix(0, 0), time.Now().UTC(),
+		sql.NullString{"", false}, pq.NullTime{time.Unix(0, 0), false}, 0}
+}
+
+// Deliver notifies the subscriber the feed changed and records how it went,
+// unsubscribing them early if they keep failing.
+func (r *RssCloud) Deliver(feedurl string) error {
+	err := r.Notify(feedurl)
+
+	r.LastAttempted.Time, r.LastAttempted.Valid = time.Now().UTC(), true
+	if err == nil {
+		r.LastStatus = sql.NullString{"ok", true}
+		r.Failures = 0
+	} else {
+		r.LastStatus = sql.NullString{truncateStatus(err.Error()), true}
+		r.Failures++
+		if r.Failures >= RSSCLOUD_MAX_FAILURES && !r.IsExpired() {
+			logr.Errln("Unsubscribing RSS cloud", r.URL, "after", r.Failures, "failed notifications")
+			r.SubscribedUntil = time.Now().UTC()
+		}
+	}
+
+	saveErr := r.Save()
+	if saveErr != nil {
+		logr.Errln("Error recording RSS cloud notification status for", r.URL, ":", saveErr.Error())
+		// but continue
+	}
+	return err
+}
+
+// Notify tells the subscriber the feed changed, with an XML-RPC call or a
+// form POST as they asked.
+func (r *RssCloud) Notify(feedurl string) error {
+	if r.Protocol == RSSCLOUD_HTTP_POST || r.Protocol == RSSCLOUD_HTTPS_POST {
+		return r.notifyByPost(feedurl)
+	}
+	return r.notifyByXmlRpc(feedurl)
+}
+
+func (r *RssCloud) notifyByPost(feedurl string) error {
+	logr.Debugln("Posting RSS cloud notification to", r.URL)
+
+	resp, err := outboundClient.PostForm(r.URL, url.Values{"url": {feedurl}})
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, MAX_DELIVERY_RESPONSE_SIZE))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Callback responded to notification with %s", resp.Status)
+	}
+
+	logr.Debugln("Sent RSS cloud notification to", r.URL)
+	return nil
 }
 
-func (r *RssCloud) Notify(feedurl string) {
+func (r *RssCloud) notifyByXmlRpc(feedurl string) error {
 	logr.Debugln("Building RSS cloud notification for", r.URL)
 
 	body := new(bytes.Buffer)
@@ -124,24 +331,64 @@ func (r *RssCloud) Notify(feedurl string) {
 			<params>
 				<param>
 					<value>`)
-	body.WriteString(feedurl)
+	body.WriteString(html.EscapeString(feedurl))
 	body.WriteString(`</value>
 				</param>
 			</params>
 		</methodCall>`)
 
-	resp, err := http.Post(r.URL, "text/xml", body)
+	resp, err := outboundClient.Post(r.URL, "text/xml", body)
 	if err != nil {
-		logr.Errln("Error posting RSS cloud notification to", r.URL, ":", err.Error())
-		return
+		return err
 	}
-	// TODO: parse resp and see if it was a fault.
-	if resp == nil {
-		logr.Errln("Didn't get a response back posting RSS cloud notification", r.URL, "!!!")
-		return
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_DELIVERY_RESPONSE_SIZE))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Callback responded to notification with %s", resp.Status)
+	}
+	err = xmlRpcFault(respBody)
+	if err != nil {
+		return err
 	}
 
 	logr.Debugln("Sent RSS cloud notification to", r.URL)
+	return nil
+}
+
+// xmlRpcFault returns the fault in an XML-RPC method response as an error, or
+// nil if it's a successful response.
+func xmlRpcFault(body []byte) error {
+	doc, err := gokogiri.ParseXml(body)
+	if err != nil {
+		return fmt.Errorf("Could not parse callback's response: %s", err.Error())
+	}
+	defer doc.Free()
+
+	root := doc.Root()
+	if root == nil || root.Name() != "methodResponse" {
+		return fmt.Errorf("Callback's response was not an XML-RPC method response")
+	}
+	faults, err := root.Search("fault")
+	if err != nil {
+		return err
+	}
+	if len(faults) == 0 {
+		return nil
+	}
+
+	code, faultString := "", ""
+	codes, err := root.Search("fault/value/struct/member[name='faultCode']/value")
+	if err == nil && len(codes) > 0 {
+		code = strings.TrimSpace(codes[0].Content())
+	}
+	faultStrings, err := root.Search("fault/value/struct/member[name='faultString']/value")
+	if err == nil && len(faultStrings) > 0 {
+		faultString = strings.TrimSpace(faultStrings[0].Content())
+	}
+	return fmt.Errorf("Callback responded with fault %s: %s", code, faultString)
 }
 
 func (r *RssCloud) Save() error {
@@ -152,20 +399,70 @@ func (r *RssCloud) Save() error {
 	return err
 }
 
+func (r *RssCloud) Delete() error {
+	_, err := db.Delete(r)
+	return err
+}
+
+func (r *RssCloud) IsExpired() bool {
+	return r.SubscribedUntil.Before(time.Now())
+}
+
+func RssCloudById(id uint64) (*RssCloud, error) {
+	rows, err := db.Select(RssCloud{},
+		"SELECT id, url, method, protocol, subscribedUntil, created, lastStatus, lastAttempted, failures FROM rsscloud WHERE id = $1",
+		id)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].(*RssCloud), nil
+}
+
+// AllRssClouds returns every rssCloud subscription, including expired ones,
+// soonest to expire first.
+func AllRssClouds() ([]*RssCloud, error) {
+	rows, err := db.Select(RssCloud{},
+		"SELECT id, url, method, protocol, subscribedUntil, created, lastStatus, lastAttempted, failures FROM rsscloud ORDER BY subscribedUntil, id")
+	if err != nil {
+		return nil, err
+	}
+
+	clouds := make([]*RssCloud, len(rows))
+	for i, row := range rows {
+		clouds[i] = row.(*RssCloud)
+	}
+	return clouds, nil
+}
+
 func RssCloudByURL(url string) (*RssCloud, error) {
 	rows, err := db.Select(RssCloud{},
-		"SELECT id, method, subscribedUntil, created FROM rsscloud WHERE url = $1",
+		"SELECT id, url, method, protocol, subscribedUntil, created, lastStatus, lastAttempted, failures FROM rsscloud WHERE url = $1",
 		url)
 	if err != nil {
 		return nil, err
 	}
-	rssCloud := rows[0].(*RssCloud)
-	return rssCloud, nil
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].(*RssCloud), nil
+}
+
+// DeleteExpiredRssClouds removes the subscriptions that ran out, returning
+// how many there were.
+func DeleteExpiredRssClouds() (int64, error) {
+	result, err := db.Exec("DELETE FROM rsscloud WHERE subscribedUntil <= $1", time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
 func ActiveRssClouds() ([]*RssCloud, error) {
 	rows, err := db.Select(RssCloud{},
-		"SELECT id, url, method, subscribedUntil, created FROM rsscloud WHERE subscribedUntil > $1",
+		"SELECT id, url, method, protocol, subscribedUntil, created, lastStatus, lastAttempted, failures FROM rsscloud WHERE subscribedUntil > $1",
 		time.Now().UTC())
 	if err != nil {
 		return nil, err
@@ -188,7 +485,13 @@ func NotifyRssCloud(feedurl string) {
 	}
 
 	for _, cloud := range clouds {
-		go cloud.Notify(feedurl)
+		cloud := cloud
+		inBackground(func() {
+			err := cloud.Deliver(feedurl)
+			if err != nil {
+				logr.Errln("Error posting RSS cloud notification to", cloud.URL, ":", err.Error())
+			}
+		})
 	}
 }
 
@@ -210,7 +513,16 @@ func writeXmlRpcError(w http.ResponseWriter, err error) {
 		        </struct>
 		     </value>
 		  </fault>
-		</methodResponse>`, err.Error())
+		</methodResponse>`, html.EscapeString(err.Error()))
+	w.Header().Set("Content-Type", "text/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(output)))
+	w.Write([]byte(output))
+}
+
+// writeRestResult answers a REST pleaseNotify request.
+func writeRestResult(w http.ResponseWriter, success bool, msg string) {
+	output := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+		<notifyResult success="%t" msg="%s"/>`, success, html.EscapeString(msg))
 	w.Header().Set("Content-Type", "text/xml")
 	w.Header().Set("Content-Length", strconv.Itoa(len(output)))
 	w.Write([]byte(output))
@@ -225,72 +537,79 @@ func rssCloud(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	bodyBytes := make([]byte, r.ContentLength)
-	_, err := r.Body.Read(bodyBytes)
-	if err != nil {
-		logr.Errln("Could not read request body:", err.Error())
-		http.Error(w, "Could not read body: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	requestDoc, err := gokogiri.ParseXml(bodyBytes)
-	if err != nil {
+	// REST subscribers post a form; XML-RPC ones post a method call.
+	isRest := strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+	writeError := func(err error) {
+		if isRest {
+			logr.Errln("Error serving rss cloud request:", err.Error())
+			writeRestResult(w, false, err.Error())
+			return
+		}
 		writeXmlRpcError(w, err)
-		return
 	}
 
 	request := new(RssCloudRequest)
-	err = request.Unpack(requestDoc)
-	if err != nil {
-		writeXmlRpcError(w, err)
-		return
-	}
-
-	hostname := r.Header.Get("X-Forwarded-For")
-	if hostname == "" {
-		hostname = r.RemoteAddr
+	if isRest {
+		r.ParseForm()
+		err := request.UnpackForm(r.PostForm)
+		if err != nil {
+			writeError(err)
+			return
+		}
 	} else {
-		hostnames := strings.SplitN(hostname, ",", 2)
-		hostname = hostnames[0]
-	}
-	host, _, err := net.SplitHostPort(hostname)
-	request.Host = host
-
-	if request.RequestMethodName != "cloud.notify" {
-		writeXmlRpcError(w, fmt.Errorf("Unknown method %s", request.RequestMethodName))
+		bodyBytes := make([]byte, r.ContentLength)
+		_, err := r.Body.Read(bodyBytes)
+		if err != nil {
+			logr.Errln("Could not read request body:", err.Error())
+			http.Error(w, "Could not read body: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		requestDoc, err := gokogiri.ParseXml(bodyBytes)
+		if err != nil {
+			writeError(err)
+			return
+		}
+
+		err = request.Unpack(requestDoc)
+		if err != nil {
+			writeError(err)
+			return
+		}
+		if request.RequestMethodName != "cloud.notify" {
+			writeError(fmt.Errorf("Unknown method %s", request.RequestMethodName))
+			return
+		}
+	}
+
+	request.Host = clientAddr(r)
+
+	switch request.Protocol {
+	case RSSCLOUD_XML_RPC:
+		if request.MethodName == "" {
+			writeError(fmt.Errorf("A notify procedure is required for XML-RPC notifications"))
+			return
+		}
+	case RSSCLOUD_HTTP_POST, RSSCLOUD_HTTPS_POST:
+	default:
+		writeError(fmt.Errorf("Protocol %s is not supported", request.Protocol))
 		return
 	}
 
-	if !request.IsXmlRpc {
-		writeXmlRpcError(w, fmt.Errorf("Only XML-RPC is supported"))
-		return
-	}
-	// TODO: use https as appropriate here? er, does river2 support cloud endpoints on HTTPS?
-	if request.FeedURL != fmt.Sprintf("http://%s/rss", r.Host) {
-		writeXmlRpcError(w, fmt.Errorf("RSS URL %s is not a feed managed here", request.FeedURL))
-		return
+	feedurl := baseUrlFor(r) + "/rss"
+	for _, requestedUrl := range request.FeedURLs {
+		if requestedUrl != feedurl {
+			writeError(fmt.Errorf("RSS URL %s is not a feed managed here", requestedUrl))
+			return
+		}
 	}
 
-	logr.Debugln("Yay, asked to call back to http://", request.Host, ":", request.Port, request.Path,
+	urlString := request.CallbackUrl()
+	logr.Debugln("Yay, asked to call back to", urlString, "by", request.Protocol,
 		"with method", request.MethodName, "!")
 
-	url, _ := url.Parse("/")
-	if request.Port == 443 {
-		url.Scheme = "https"
-	} else {
-		url.Scheme = "http"
-	}
-	if request.Port == 80 || request.Port == 443 {
-		url.Host = request.Host
-	} else {
-		url.Host = net.JoinHostPort(request.Host, strconv.Itoa(int(request.Port)))
-	}
-	url.Path = request.Path
-	urlString := url.String()
-
+	// Asking again renews an existing subscription.
 	rssCloud, err := RssCloudByURL(urlString)
-	if err == sql.ErrNoRows {
-		// That's cool.
-	} else if err != nil {
+	if err != nil {
 		logr.Errln("Error loading rsscloud for URL", urlString, ":", err.Error())
 		http.Error(w, "error looking for rsscloud for URL "+urlString, http.StatusInternalServerError)
 		return
@@ -300,8 +619,18 @@ func rssCloud(w http.ResponseWriter, r *http.Request) {
 		rssCloud.URL = urlString
 	}
 	rssCloud.Method = request.MethodName
-	// Subscribe until 25 hours from now.
-	rssCloud.SubscribedUntil = time.Now().Add(time.Duration(25) * time.Hour).UTC()
+	rssCloud.Protocol = request.Protocol
+
+	err = request.Verify(rssCloud, feedurl)
+	if err != nil {
+		writeError(fmt.Errorf("Could not verify %s: %s", urlString, err.Error()))
+		return
+	}
+
+	// Having just shown it works, the subscriber starts over on failures.
+	rssCloud.SubscribedUntil = time.Now().Add(RSSCLOUD_LEASE).UTC()
+	rssCloud.Failures = 0
+	rssCloud.LastStatus = sql.NullString{"", false}
 	err = rssCloud.Save()
 	if err != nil {
 		logr.Errln("Error saving rsscloud for URL", urlString, ":", err.Error())
@@ -309,6 +638,11 @@ func rssCloud(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isRest {
+		writeRestResult(w, true, "Thanks for the registration. It worked. When the feed updates we'll notify you.")
+		return
+	}
+
 	output := `<?xml version="1.0" encoding="UTF-8"?>
 		<methodResponse>
 			<params>
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const SCHEDULER_INTERVAL = time.Minute
+
+const SCHEDULING_NEEDS_BASE_URL = "scheduling posts requires the site to be run with --base-url, so subscribers can be told when they're published"
+
+// canSchedule checks we can notify subscribers of posts published later,
+// without a request to tell us where the site is. If not, it writes an error
+// and returns false.
+func canSchedule(w http.ResponseWriter) bool {
+	if siteBaseUrl == "" {
+		http.Error(w, SCHEDULING_NEEDS_BASE_URL, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// PublishDuePosts publishes the scheduled posts whose time has come. Without
+// a --base-url we couldn't tell anyone about them, so they wait until the
+// site is run with one.
+func PublishDuePosts() {
+	posts, err := ScheduledPostsDue(time.Now())
+	if err != nil {
+		logr.Errln("Error finding scheduled posts to publish:", err.Error())
+		return
+	}
+	if len(posts) > 0 && siteBaseUrl == "" {
+		logr.Errln("Not publishing", len(posts), "scheduled posts until there's a --base-url to notify subscribers with")
+		return
+	}
+
+	for _, post := range posts {
+		logr.Debugln("Publishing scheduled post", post.Id)
+		err = post.Publish()
+		if err != nil {
+			logr.Errln("Error publishing scheduled post", post.Id, ":", err.Error())
+			continue
+		}
+
+		notifyOfPost(baseUrlFor(nil), post)
+	}
+}
+
+// RunScheduler publishes due posts every so often until stopping is closed.
+func RunScheduler(stopping <-chan struct{}) {
+	for {
+		PublishDuePosts()
+		select {
+		case <-stopping:
+			return
+		case <-time.After(SCHEDULER_INTERVAL):
+		}
+	}
+}
@@ -0,0 +1,6 @@
+CREATE TABLE revision (
+	id SERIAL PRIMARY KEY,
+	postid INTEGER NOT NULL REFERENCES post(id),
+	html CHARACTER VARYING NOT NULL,
+	created TIMESTAMP NOT NULL DEFAULT NOW()
+);
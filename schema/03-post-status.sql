@@ -0,0 +1 @@
+ALTER TABLE post ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'published';
@@ -0,0 +1,8 @@
+CREATE TABLE tag (
+	id SERIAL PRIMARY KEY,
+	postid INTEGER NOT NULL REFERENCES post(id),
+	name VARCHAR(100) NOT NULL,
+	UNIQUE(postid, name)
+);
+
+CREATE INDEX tag_name ON tag (name);
@@ -0,0 +1,15 @@
+CREATE TABLE actorkey (
+	id SERIAL PRIMARY KEY,
+	accountid INTEGER UNIQUE NOT NULL REFERENCES account(id),
+	privatekey CHARACTER VARYING NOT NULL,
+	created TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE follower (
+	id SERIAL PRIMARY KEY,
+	accountid INTEGER NOT NULL REFERENCES account(id),
+	actor VARCHAR(1024) NOT NULL,
+	inbox VARCHAR(1024) NOT NULL,
+	created TIMESTAMP NOT NULL DEFAULT NOW(),
+	UNIQUE(accountid, actor)
+);
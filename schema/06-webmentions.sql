@@ -0,0 +1,10 @@
+CREATE TABLE webmention (
+	id SERIAL PRIMARY KEY,
+	postid INTEGER NOT NULL REFERENCES post(id),
+	source VARCHAR(1024) NOT NULL,
+	target VARCHAR(1024) NOT NULL,
+	title CHARACTER VARYING,
+	verified TIMESTAMP NOT NULL,
+	created TIMESTAMP NOT NULL DEFAULT NOW(),
+	UNIQUE(source, target)
+);
@@ -0,0 +1,22 @@
+CREATE TABLE token (
+	id SERIAL PRIMARY KEY,
+	accountid INTEGER NOT NULL REFERENCES account(id),
+	tokenhash VARCHAR(64) UNIQUE NOT NULL,
+	name CHARACTER VARYING NOT NULL,
+	scope CHARACTER VARYING NOT NULL,
+	created TIMESTAMP NOT NULL DEFAULT NOW(),
+	lastused TIMESTAMP,
+	revoked TIMESTAMP
+);
+
+CREATE TABLE authcode (
+	id SERIAL PRIMARY KEY,
+	accountid INTEGER NOT NULL REFERENCES account(id),
+	codehash VARCHAR(64) UNIQUE NOT NULL,
+	clientid VARCHAR(1024) NOT NULL,
+	redirecturi VARCHAR(1024) NOT NULL,
+	scope CHARACTER VARYING NOT NULL,
+	codechallenge CHARACTER VARYING,
+	created TIMESTAMP NOT NULL DEFAULT NOW(),
+	used TIMESTAMP
+);
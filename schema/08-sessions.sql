@@ -0,0 +1,13 @@
+CREATE TABLE setting (
+	name VARCHAR(100) PRIMARY KEY,
+	value CHARACTER VARYING NOT NULL
+);
+
+CREATE TABLE session (
+	id SERIAL PRIMARY KEY,
+	accountid INTEGER NOT NULL REFERENCES account(id),
+	sessionhash VARCHAR(64) UNIQUE NOT NULL,
+	csrftoken VARCHAR(64) NOT NULL,
+	created TIMESTAMP NOT NULL DEFAULT NOW(),
+	expires TIMESTAMP NOT NULL
+);
@@ -0,0 +1,9 @@
+CREATE TABLE audit (
+	id SERIAL PRIMARY KEY,
+	accountname VARCHAR(100) NOT NULL,
+	clientaddr VARCHAR(100) NOT NULL,
+	event VARCHAR(20) NOT NULL,
+	created TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_created ON audit (created);
@@ -0,0 +1,14 @@
+CREATE TABLE totp (
+	id SERIAL PRIMARY KEY,
+	accountid INTEGER UNIQUE NOT NULL REFERENCES account(id),
+	secret VARCHAR(64) NOT NULL,
+	laststep BIGINT NOT NULL DEFAULT 0,
+	created TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE recoverycode (
+	id SERIAL PRIMARY KEY,
+	accountid INTEGER NOT NULL REFERENCES account(id),
+	codehash VARCHAR(64) UNIQUE NOT NULL,
+	used TIMESTAMP
+);
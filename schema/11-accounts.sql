@@ -0,0 +1,17 @@
+ALTER TABLE account ADD COLUMN authorid INTEGER UNIQUE REFERENCES author(id);
+
+UPDATE account SET authorid = (SELECT id FROM author WHERE url = '/') WHERE id = (SELECT MIN(id) FROM account);
+
+INSERT INTO author (name, url) SELECT displayName, '/~' || name || '/' FROM account WHERE authorid IS NULL;
+
+UPDATE account SET authorid = author.id FROM author WHERE account.authorid IS NULL AND author.url = '/~' || account.name || '/';
+
+ALTER TABLE account ALTER COLUMN authorid SET NOT NULL;
+
+ALTER TABLE post ADD COLUMN accountid INTEGER REFERENCES account(id);
+
+UPDATE post SET accountid = (SELECT MIN(id) FROM account);
+
+ALTER TABLE post ALTER COLUMN accountid SET NOT NULL;
+
+CREATE INDEX post_accountid ON post (accountid);
@@ -0,0 +1,17 @@
+ALTER TABLE subscription ADD COLUMN laststatus VARCHAR(100);
+
+ALTER TABLE subscription ADD COLUMN lastattempted TIMESTAMP;
+
+ALTER TABLE subscription ADD COLUMN lastdelivered TIMESTAMP;
+
+CREATE TABLE delivery (
+	id SERIAL PRIMARY KEY,
+	subscriptionid INTEGER NOT NULL REFERENCES subscription(id) ON DELETE CASCADE,
+	body CHARACTER VARYING NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	nextattempt TIMESTAMP NOT NULL,
+	laststatus VARCHAR(100),
+	created TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX delivery_nextattempt ON delivery (nextattempt);
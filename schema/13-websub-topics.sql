@@ -0,0 +1,20 @@
+ALTER TABLE subscription ADD COLUMN topic VARCHAR(1024) NOT NULL DEFAULT '/atom';
+
+ALTER TABLE subscription ALTER COLUMN topic DROP DEFAULT;
+
+DELETE FROM subscription older USING subscription newer
+	WHERE older.url = newer.url AND older.topic = newer.topic AND older.id < newer.id;
+
+ALTER TABLE subscription ADD CONSTRAINT subscription_url_topic UNIQUE (url, topic);
+
+ALTER TABLE delivery ADD COLUMN huburl VARCHAR(1024) NOT NULL DEFAULT '';
+
+ALTER TABLE delivery ADD COLUMN topicurl VARCHAR(1024) NOT NULL DEFAULT '';
+
+ALTER TABLE delivery ADD COLUMN contenttype VARCHAR(100) NOT NULL DEFAULT 'application/atom+xml';
+
+ALTER TABLE delivery ALTER COLUMN huburl DROP DEFAULT;
+
+ALTER TABLE delivery ALTER COLUMN topicurl DROP DEFAULT;
+
+ALTER TABLE delivery ALTER COLUMN contenttype DROP DEFAULT;
@@ -0,0 +1 @@
+ALTER TABLE subscription ADD COLUMN failures INTEGER NOT NULL DEFAULT 0;
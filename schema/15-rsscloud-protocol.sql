@@ -0,0 +1,3 @@
+ALTER TABLE rsscloud ADD COLUMN protocol VARCHAR(20) NOT NULL DEFAULT 'xml-rpc';
+
+ALTER TABLE rsscloud ALTER COLUMN protocol DROP DEFAULT;
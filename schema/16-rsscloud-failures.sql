@@ -0,0 +1,5 @@
+ALTER TABLE rsscloud ADD COLUMN laststatus VARCHAR(100);
+
+ALTER TABLE rsscloud ADD COLUMN lastattempted TIMESTAMP;
+
+ALTER TABLE rsscloud ADD COLUMN failures INTEGER NOT NULL DEFAULT 0;
@@ -3,29 +3,34 @@ CREATE TABLE schema (
 	upgraded TIMESTAMP NOT NULL DEFAULT NOW()
 );
 
-CREATE TABLE account (
-	id SERIAL PRIMARY KEY,
-	name VARCHAR(30) UNIQUE NOT NULL,
-	passwordHash VARCHAR(60) NOT NULL,
-	displayName CHARACTER VARYING NOT NULL
-);
-
 CREATE TABLE author (
 	id SERIAL PRIMARY KEY,
 	name CHARACTER VARYING NOT NULL,
 	url VARCHAR(1024) UNIQUE NOT NULL
 );
 
+CREATE TABLE account (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(30) UNIQUE NOT NULL,
+	passwordHash VARCHAR(60) NOT NULL,
+	displayName CHARACTER VARYING NOT NULL,
+	authorid INTEGER UNIQUE NOT NULL REFERENCES author(id)
+);
+
 CREATE TABLE post (
 	id SERIAL PRIMARY KEY,
 	authorid INTEGER NOT NULL REFERENCES author(id),
+	accountid INTEGER NOT NULL REFERENCES account(id),
 	url VARCHAR(1024),
 	html CHARACTER VARYING NOT NULL,
 	posted TIMESTAMP WITH TIME ZONE NOT NULL,
 	created TIMESTAMP NOT NULL DEFAULT NOW(),
-	deleted TIMESTAMP
+	deleted TIMESTAMP,
+	status VARCHAR(20) NOT NULL DEFAULT 'published'
 );
 
+CREATE INDEX post_accountid ON post (accountid);
+
 CREATE TABLE writestream (
 	id SERIAL PRIMARY KEY,
 	postid INTEGER NOT NULL REFERENCES post(id),
@@ -35,17 +40,42 @@ CREATE TABLE writestream (
 CREATE TABLE subscription (
 	id SERIAL PRIMARY KEY,
 	url CHARACTER VARYING NOT NULL,
+	topic VARCHAR(1024) NOT NULL,
 	leaseuntil TIMESTAMP NOT NULL,
 	secret CHARACTER VARYING,
+	created TIMESTAMP NOT NULL DEFAULT NOW(),
+	laststatus VARCHAR(100),
+	lastattempted TIMESTAMP,
+	lastdelivered TIMESTAMP,
+	failures INTEGER NOT NULL DEFAULT 0,
+	CONSTRAINT subscription_url_topic UNIQUE (url, topic)
+);
+
+CREATE TABLE delivery (
+	id SERIAL PRIMARY KEY,
+	subscriptionid INTEGER NOT NULL REFERENCES subscription(id) ON DELETE CASCADE,
+	huburl VARCHAR(1024) NOT NULL,
+	topicurl VARCHAR(1024) NOT NULL,
+	contenttype VARCHAR(100) NOT NULL,
+	body CHARACTER VARYING NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	nextattempt TIMESTAMP NOT NULL,
+	laststatus VARCHAR(100),
 	created TIMESTAMP NOT NULL DEFAULT NOW()
 );
 
+CREATE INDEX delivery_nextattempt ON delivery (nextattempt);
+
 CREATE TABLE rsscloud (
 	id SERIAL,
 	url VARCHAR(1024) UNIQUE NOT NULL,
 	method VARCHAR(100) NOT NULL,
+	protocol VARCHAR(20) NOT NULL,
 	subscribedUntil TIMESTAMP NOT NULL,
-	created TIMESTAMP NOT NULL DEFAULT NOW()
+	created TIMESTAMP NOT NULL DEFAULT NOW(),
+	laststatus VARCHAR(100),
+	lastattempted TIMESTAMP,
+	failures INTEGER NOT NULL DEFAULT 0
 );
 
 CREATE TABLE import (
@@ -55,3 +85,108 @@ CREATE TABLE import (
 	identifier CHARACTER VARYING NOT NULL,
 	UNIQUE(source, identifier)
 );
+
+CREATE TABLE revision (
+	id SERIAL PRIMARY KEY,
+	postid INTEGER NOT NULL REFERENCES post(id),
+	html CHARACTER VARYING NOT NULL,
+	created TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE tag (
+	id SERIAL PRIMARY KEY,
+	postid INTEGER NOT NULL REFERENCES post(id),
+	name VARCHAR(100) NOT NULL,
+	UNIQUE(postid, name)
+);
+
+CREATE INDEX tag_name ON tag (name);
+
+CREATE TABLE actorkey (
+	id SERIAL PRIMARY KEY,
+	accountid INTEGER UNIQUE NOT NULL REFERENCES account(id),
+	privatekey CHARACTER VARYING NOT NULL,
+	created TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE follower (
+	id SERIAL PRIMARY KEY,
+	accountid INTEGER NOT NULL REFERENCES account(id),
+	actor VARCHAR(1024) NOT NULL,
+	inbox VARCHAR(1024) NOT NULL,
+	created TIMESTAMP NOT NULL DEFAULT NOW(),
+	UNIQUE(accountid, actor)
+);
+
+CREATE TABLE webmention (
+	id SERIAL PRIMARY KEY,
+	postid INTEGER NOT NULL REFERENCES post(id),
+	source VARCHAR(1024) NOT NULL,
+	target VARCHAR(1024) NOT NULL,
+	title CHARACTER VARYING,
+	verified TIMESTAMP NOT NULL,
+	created TIMESTAMP NOT NULL DEFAULT NOW(),
+	UNIQUE(source, target)
+);
+
+CREATE TABLE token (
+	id SERIAL PRIMARY KEY,
+	accountid INTEGER NOT NULL REFERENCES account(id),
+	tokenhash VARCHAR(64) UNIQUE NOT NULL,
+	name CHARACTER VARYING NOT NULL,
+	scope CHARACTER VARYING NOT NULL,
+	created TIMESTAMP NOT NULL DEFAULT NOW(),
+	lastused TIMESTAMP,
+	revoked TIMESTAMP
+);
+
+CREATE TABLE authcode (
+	id SERIAL PRIMARY KEY,
+	accountid INTEGER NOT NULL REFERENCES account(id),
+	codehash VARCHAR(64) UNIQUE NOT NULL,
+	clientid VARCHAR(1024) NOT NULL,
+	redirecturi VARCHAR(1024) NOT NULL,
+	scope CHARACTER VARYING NOT NULL,
+	codechallenge CHARACTER VARYING,
+	created TIMESTAMP NOT NULL DEFAULT NOW(),
+	used TIMESTAMP
+);
+
+CREATE TABLE setting (
+	name VARCHAR(100) PRIMARY KEY,
+	value CHARACTER VARYING NOT NULL
+);
+
+CREATE TABLE session (
+	id SERIAL PRIMARY KEY,
+	accountid INTEGER NOT NULL REFERENCES account(id),
+	sessionhash VARCHAR(64) UNIQUE NOT NULL,
+	csrftoken VARCHAR(64) NOT NULL,
+	created TIMESTAMP NOT NULL DEFAULT NOW(),
+	expires TIMESTAMP NOT NULL
+);
+
+CREATE TABLE audit (
+	id SERIAL PRIMARY KEY,
+	accountname VARCHAR(100) NOT NULL,
+	clientaddr VARCHAR(100) NOT NULL,
+	event VARCHAR(20) NOT NULL,
+	created TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_created ON audit (created);
+
+CREATE TABLE totp (
+	id SERIAL PRIMARY KEY,
+	accountid INTEGER UNIQUE NOT NULL REFERENCES account(id),
+	secret VARCHAR(64) NOT NULL,
+	laststep BIGINT NOT NULL DEFAULT 0,
+	created TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE recoverycode (
+	id SERIAL PRIMARY KEY,
+	accountid INTEGER NOT NULL REFERENCES account(id),
+	codehash VARCHAR(64) UNIQUE NOT NULL,
+	used TIMESTAMP
+);
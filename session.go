@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/hoisie/mustache"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	SESSION_COOKIE   = "cares_session"
+	SESSION_LIFETIME = 14 * 24 * time.Hour
+)
+
+type Session struct {
+	Id          int64
+	AccountId   int64
+	SessionHash string
+	CsrfToken   string
+	Created     time.Time
+	Expires     time.Time
+}
+
+var sessionSecret []byte
+
+// NewSession makes a login session for the account, returning the session and
+// its secret value. Only the value's hash is saved.
+func NewSession(account *Account) (*Session, string, error) {
+	value, err := RandomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	csrfToken, err := RandomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now().UTC()
+	session := &Session{0, account.Id, HashToken(value), csrfToken, now, now.Add(SESSION_LIFETIME)}
+	return session, value, nil
+}
+
+func (s *Session) Save() error {
+	if s.Id == 0 {
+		return db.Insert(s)
+	}
+	_, err := db.Update(s)
+	return err
+}
+
+func (s *Session) Delete() error {
+	_, err := db.Delete(s)
+	return err
+}
+
+// HasCsrfToken checks the request carries the session's CSRF token, either in
+// an X-CSRF-Token header (as our scripts send it) or a csrf_token form field.
+func (s *Session) HasCsrfToken(r *http.Request) bool {
+	given := r.Header.Get("X-CSRF-Token")
+	if given == "" {
+		given = r.PostFormValue("csrf_token")
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(s.CsrfToken)) == 1
+}
+
+// SessionByValue finds the unexpired session with the given secret value.
+func SessionByValue(value string) (*Session, error) {
+	rows, err := db.Select(Session{},
+		"SELECT id, accountId, sessionHash, csrfToken, created, expires FROM session WHERE sessionHash = $1 AND expires > $2",
+		HashToken(value), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].(*Session), nil
+}
+
+func DeleteExpiredSessions() error {
+	_, err := db.Exec("DELETE FROM session WHERE expires <= $1", time.Now().UTC())
+	return err
+}
+
+// LoadSessionSecret loads the key we sign session cookies with, making one the
+// first time.
+func LoadSessionSecret() error {
+	secret, err := SettingValue("session_secret", func() (string, error) {
+		return RandomToken(32)
+	})
+	if err != nil {
+		return err
+	}
+	sessionSecret = []byte(secret)
+	return nil
+}
+
+func signSessionValue(value string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sessionValueFromCookie returns the session value from a signed cookie value,
+// if the signature is good.
+func sessionValueFromCookie(cookieValue string) (string, bool) {
+	dot := strings.LastIndex(cookieValue, ".")
+	if dot < 0 || len(sessionSecret) == 0 {
+		return "", false
+	}
+	value := cookieValue[:dot]
+	if !hmac.Equal([]byte(signSessionValue(value)), []byte(cookieValue)) {
+		return "", false
+	}
+	return value, true
+}
+
+// SessionForRequest returns the login session the request's cookie is for,
+// if any.
+func SessionForRequest(r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return nil, nil
+	}
+	value, ok := sessionValueFromCookie(cookie.Value)
+	if !ok {
+		logr.Debugln("Ignoring session cookie with a bad signature")
+		return nil, nil
+	}
+	return SessionByValue(value)
+}
+
+// csrfTokenFor returns the CSRF token for pages to send back with changes, if
+// the request is from a logged in browser.
+func csrfTokenFor(r *http.Request) string {
+	session, err := SessionForRequest(r)
+	if err != nil {
+		logr.Errln("Error loading session for CSRF token:", err.Error())
+		return ""
+	}
+	if session == nil {
+		return ""
+	}
+	return session.CsrfToken
+}
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   strings.HasPrefix(baseUrlFor(r), "https:"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// localRedirect returns where to send the browser after logging in, as long
+// as it's somewhere on this site.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func renderLogin(w http.ResponseWriter, status int, next, message string) {
+	owner := AccountForOwner()
+	data := map[string]interface{}{
+		"Next":      next,
+		"Message":   message,
+		"OwnerName": owner.DisplayName,
+	}
+	html := mustache.RenderFile("html/login.html", data)
+	w.WriteHeader(status)
+	w.Write([]byte(html))
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		renderLogin(w, http.StatusOK, localRedirect(r.FormValue("next")), "")
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "GET or POST is required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	next := localRedirect(r.PostFormValue("next"))
+	name, pass := r.PostFormValue("name"), r.PostFormValue("password")
+	account, wait, err := CheckPassword(r, name, pass)
+	if err != nil {
+		logr.Errln("Error loading account", name, "to log in:", err.Error())
+		http.Error(w, "error loading auth information", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		setRetryAfter(w, wait)
+		renderLogin(w, http.StatusTooManyRequests, next, "There have been too many failed logins. Try again later.")
+		return
+	}
+	if account == nil {
+		renderLogin(w, http.StatusUnauthorized, next, "That name and password didn't match.")
+		return
+	}
+
+	totp, err := TotpForAccount(account.Id)
+	if err != nil {
+		logr.Errln("Error loading two-factor secret for", name, ":", err.Error())
+		http.Error(w, "error loading auth information", http.StatusInternalServerError)
+		return
+	}
+	if totp != nil {
+		ok, err := CheckSecondFactor(r, account, totp, r.PostFormValue("code"))
+		if err != nil {
+			logr.Errln("Error checking two-factor code for", name, ":", err.Error())
+			http.Error(w, "error loading auth information", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			renderLogin(w, http.StatusUnauthorized, next, "Enter the current code from your authenticator app, or a recovery code.")
+			return
+		}
+	}
+
+	clearAuthFailures(name, clientAddr(r))
+	RecordAuditEvent(name, clientAddr(r), AUDIT_LOGIN)
+
+	err = DeleteExpiredSessions()
+	if err != nil {
+		logr.Errln("Error deleting expired sessions:", err.Error())
+		// but continue
+	}
+
+	session, value, err := NewSession(account)
+	if err == nil {
+		err = session.Save()
+	}
+	if err != nil {
+		logr.Errln("Error making session:", err.Error())
+		http.Error(w, "error making session", http.StatusInternalServerError)
+		return
+	}
+
+	setSessionCookie(w, r, signSessionValue(value), session.Expires)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST is required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := SessionForRequest(r)
+	if err != nil {
+		logr.Errln("Error loading session to log out:", err.Error())
+		http.Error(w, "error loading session", http.StatusInternalServerError)
+		return
+	}
+	if session != nil {
+		if !session.HasCsrfToken(r) {
+			http.Error(w, "missing or incorrect CSRF token", http.StatusForbidden)
+			return
+		}
+		err = session.Delete()
+		if err != nil {
+			logr.Errln("Error deleting session", session.Id, ":", err.Error())
+			http.Error(w, "error deleting session", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	setSessionCookie(w, r, "", time.Unix(0, 0))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SHUTDOWN_TIMEOUT is how long we give in-flight requests and background
+// notifications to finish once asked to stop. Supervisor's stopwaitsecs
+// should be longer.
+const SHUTDOWN_TIMEOUT = 25 * time.Second
+
+// backgroundWork tracks the notifications and other work going on after the
+// requests that started it were answered.
+var backgroundWork sync.WaitGroup
+
+// inBackground does work in its own goroutine, like a go statement, but so
+// that shutting down waits for it to finish.
+func inBackground(work func()) {
+	backgroundWork.Add(1)
+	go func() {
+		defer backgroundWork.Done()
+		work()
+	}()
+}
+
+// waitForBackground waits until the background work is done or the deadline
+// passes, reporting whether it finished.
+func waitForBackground(deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		backgroundWork.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
+// serveUntilStopped runs the servers (with HTTPS for those with a TLS config)
+// until one fails or we get SIGTERM or SIGINT, then shuts them down
+// gracefully: they stop accepting connections and finish the requests they're
+// handling, then we wait for the background work those requests started.
+// Closing stopping tells other loops to stop too.
+func serveUntilStopped(servers []*http.Server, stopping chan struct{}) {
+	failed := make(chan error, len(servers))
+	for _, server := range servers {
+		server := server
+		go func() {
+			var err error
+			if server.TLSConfig != nil {
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				failed <- err
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-failed:
+		logr.Errln("Error serving web:", err.Error())
+	case sig := <-signals:
+		logr.Debugln("Got", sig, "signal, so shutting down")
+	}
+
+	deadline := time.Now().Add(SHUTDOWN_TIMEOUT)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			logr.Errln("Error shutting down server on", server.Addr, ":", err.Error())
+		}
+	}
+	close(stopping)
+
+	if !waitForBackground(deadline) {
+		logr.Errln("Gave up waiting for background notifications to finish after", SHUTDOWN_TIMEOUT)
+		return
+	}
+	logr.Debugln("Finished background work, bye")
+}
@@ -22,6 +22,14 @@ $(function() {
 		};
 
 		Editor.prototype.submit = function () {
+			return this.save(false);
+		};
+
+		Editor.prototype.saveDraft = function () {
+			return this.save(true);
+		};
+
+		Editor.prototype.save = function (draft) {
 			var editor = this;
 			var $body = editor.$el.find('.body');
 
@@ -30,6 +38,8 @@ $(function() {
 			};
 			if (!data['html'])
 				return false;
+			if (draft)
+				data['draft'] = '1';
 
 			$.ajax({
 				url: '/post',
@@ -39,6 +49,10 @@ $(function() {
 				success: function (data, textStatus, xhr) {
 					editor.reset();
 
+					// Drafts don't go in the stream.
+					if (draft)
+						return;
+
 					// Add the new one.
 					var $oldpost = editor.$el.find('.post');
 					var $post = $oldpost.clone();
@@ -75,6 +89,7 @@ $(function() {
 		Editor.prototype.setUp = function () {
 			var $body = this.$el.find('.body');
 			$body.bind('keydown.return', this.submit.bind(this));
+			$body.bind('keydown.ctrl_s', this.saveDraft.bind(this));
 			$body.bind('keydown.esc', this.reset.bind(this));
 			$body.bind('keydown.ctrl_l', this.makeLink.bind(this));
 			$body.bind('paste', (function (e) {
@@ -3,6 +3,7 @@ $(function() {
 
         var showingMore = false;
         var oldestItemDate;
+        var streamUrl = '/stream';
 
         function showMore() {
             if (showingMore) return;
@@ -13,7 +14,7 @@ $(function() {
             $nav.find('.loading').show();
 
             $.ajax({
-                url: '/stream',
+                url: streamUrl,
                 data: { before: oldestItemDate },
                 success: function (data) {
                     // put the posts in the page
@@ -42,8 +43,9 @@ $(function() {
             });
         }
 
-        $.fn.loadMore = function (datestamp) {
+        $.fn.loadMore = function (datestamp, url) {
             oldestItemDate = datestamp;
+            if (url) streamUrl = url;
 
             var moreShower = showMore.bind(this);
             this.find('.load-more button').click(moreShower);
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/hoisie/mustache"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// subscriptionData describes a hub subscriber for the subscribers page and
+// its JSON.
+func subscriptionData(baseurl string, sub *Subscription) map[string]interface{} {
+	data := map[string]interface{}{
+		"kind":       "websub",
+		"id":         sub.Id,
+		"callback":   sub.Url,
+		"topic":      baseurl + sub.Topic,
+		"leaseUntil": sub.LeaseUntil.UTC().Format(time.RFC3339),
+		"expired":    sub.IsExpired(),
+		"hasSecret":  sub.Secret.Valid,
+		"failures":   sub.Failures,
+	}
+	if sub.LastStatus.Valid {
+		data["lastStatus"] = sub.LastStatus.String
+	}
+	if sub.LastAttempted.Valid {
+		data["lastAttempted"] = sub.LastAttempted.Time.UTC().Format(time.RFC3339)
+	}
+	if sub.LastDelivered.Valid {
+		data["lastDelivered"] = sub.LastDelivered.Time.UTC().Format(time.RFC3339)
+	}
+	return data
+}
+
+// rssCloudData describes an rssCloud subscriber for the subscribers page and
+// its JSON.
+func rssCloudData(baseurl string, cloud *RssCloud) map[string]interface{} {
+	data := map[string]interface{}{
+		"kind":       "rsscloud",
+		"id":         cloud.Id,
+		"callback":   cloud.URL,
+		"topic":      baseurl + "/rss",
+		"method":     cloud.Method,
+		"protocol":   cloud.Protocol,
+		"leaseUntil": cloud.SubscribedUntil.UTC().Format(time.RFC3339),
+		"expired":    cloud.IsExpired(),
+		"hasSecret":  false,
+		"failures":   cloud.Failures,
+	}
+	if cloud.LastStatus.Valid {
+		data["lastStatus"] = cloud.LastStatus.String
+	}
+	if cloud.LastAttempted.Valid {
+		data["lastAttempted"] = cloud.LastAttempted.Time.UTC().Format(time.RFC3339)
+	}
+	return data
+}
+
+// testSubscription sends the subscriber its topic's feed as it is now,
+// recording how it went like any other delivery.
+func testSubscription(baseurl string, sub *Subscription) (bool, string, error) {
+	topic, err := ParseFeedTopic(baseurl, baseurl+sub.Topic)
+	if err != nil {
+		return false, "", err
+	}
+	if topic == nil {
+		return false, "", fmt.Errorf("Topic %s is no longer a feed here", sub.Topic)
+	}
+	content, err := topic.CurrentContent(baseurl)
+	if err != nil {
+		return false, "", err
+	}
+
+	now := time.Now().UTC()
+	delivery := &Delivery{0, sub.Id, hubUrl(baseurl), baseurl + sub.Topic, topic.ContentType(), content, 0, now, sql.NullString{"", false}, now}
+	ok, status := sub.Deliver(delivery)
+	status = truncateStatus(status)
+	sub.RecordAttempt(ok, status)
+	return ok, status, sub.Save()
+}
+
+// changeSubscriber revokes or tests the subscriber the form names, returning
+// whether it worked and a message saying how it went. An empty message means
+// there's no such subscriber.
+func changeSubscriber(baseurl string, r *http.Request) (bool, string, error) {
+	id, err := strconv.ParseUint(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		return false, "", nil
+	}
+	action := r.PostFormValue("action")
+
+	switch r.PostFormValue("kind") {
+	case "websub":
+		sub, err := SubscriptionById(id)
+		if err != nil || sub == nil {
+			return false, "", err
+		}
+		if action == "test" {
+			ok, status, err := testSubscription(baseurl, sub)
+			if err != nil {
+				return false, "", err
+			}
+			return ok, fmt.Sprintf("Test notification to %s: %s", sub.Url, status), nil
+		}
+		err = sub.Delete()
+		if err != nil {
+			return false, "", err
+		}
+		return true, fmt.Sprintf("Revoked %s", sub.Url), nil
+
+	case "rsscloud":
+		cloud, err := RssCloudById(id)
+		if err != nil || cloud == nil {
+			return false, "", err
+		}
+		if action == "test" {
+			err = cloud.Deliver(baseurl + "/rss")
+			if err != nil {
+				return false, fmt.Sprintf("Test notification to %s: %s", cloud.URL, err.Error()), nil
+			}
+			return true, fmt.Sprintf("Test notification to %s: sent", cloud.URL), nil
+		}
+		err = cloud.Delete()
+		if err != nil {
+			return false, "", err
+		}
+		return true, fmt.Sprintf("Revoked %s", cloud.URL), nil
+	}
+	return false, "", nil
+}
+
+// subscribers lets the site owner see who's subscribed to the hub and
+// rssCloud, revoke them, and send them test notifications. It serves JSON to
+// clients that ask for it.
+func subscribers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "GET or POST is required", http.StatusMethodNotAllowed)
+		return
+	}
+	// Revoking and testing must come from the owner's logged in browser, so
+	// no other site can make their browser do it.
+	var account *Account
+	if r.Method == "POST" {
+		account = AccountLoggedIn(w, r)
+	} else {
+		account = AccountAuthedInPerson(w, r)
+	}
+	if account == nil {
+		return
+	}
+	if !account.IsOwner() {
+		http.Error(w, "only the site owner can manage subscribers", http.StatusForbidden)
+		return
+	}
+
+	baseurl := baseUrlFor(r)
+	wantsJson := strings.Contains(r.Header.Get("Accept"), "application/json")
+	w.Header().Set("Vary", "Accept")
+
+	message := ""
+	if r.Method == "POST" {
+		r.ParseForm()
+		action := r.PostFormValue("action")
+		if action != "revoke" && action != "test" {
+			http.Error(w, "action must be revoke or test", http.StatusBadRequest)
+			return
+		}
+
+		ok, result, err := changeSubscriber(baseurl, r)
+		if err != nil {
+			logr.Errln("Error changing subscriber", r.PostFormValue("kind"), r.PostFormValue("id"), ":", err.Error())
+			http.Error(w, "error changing subscriber", http.StatusInternalServerError)
+			return
+		}
+		if result == "" {
+			http.Error(w, "no such subscriber", http.StatusNotFound)
+			return
+		}
+
+		if wantsJson {
+			ret, err := json.Marshal(map[string]interface{}{"ok": ok, "message": result})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(ret)
+			return
+		}
+		if action == "revoke" {
+			http.Redirect(w, r, "/subscribers", http.StatusSeeOther)
+			return
+		}
+		message = result
+	}
+
+	subs, err := AllSubscriptions()
+	if err != nil {
+		logr.Errln("Error loading subscriptions:", err.Error())
+		http.Error(w, "error loading subscribers", http.StatusInternalServerError)
+		return
+	}
+	clouds, err := AllRssClouds()
+	if err != nil {
+		logr.Errln("Error loading rssCloud subscriptions:", err.Error())
+		http.Error(w, "error loading subscribers", http.StatusInternalServerError)
+		return
+	}
+
+	websubData := make([]map[string]interface{}, len(subs))
+	for i, sub := range subs {
+		websubData[i] = subscriptionData(baseurl, sub)
+	}
+	cloudData := make([]map[string]interface{}, len(clouds))
+	for i, cloud := range clouds {
+		cloudData[i] = rssCloudData(baseurl, cloud)
+	}
+
+	if wantsJson {
+		ret, err := json.Marshal(map[string]interface{}{
+			"websub":   websubData,
+			"rsscloud": cloudData,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(ret)
+		return
+	}
+
+	// The page shows times readably rather than as in the JSON.
+	for i, sub := range subs {
+		websubData[i]["LeaseDate"] = sub.LeaseUntil.Format("3:04 PM _2 Jan 2006")
+		if sub.LastAttempted.Valid {
+			websubData[i]["LastAttemptedDate"] = sub.LastAttempted.Time.Format("3:04 PM _2 Jan 2006")
+		}
+	}
+	for i, cloud := range clouds {
+		cloudData[i]["LeaseDate"] = cloud.SubscribedUntil.Format("3:04 PM _2 Jan 2006")
+		if cloud.LastAttempted.Valid {
+			cloudData[i]["LastAttemptedDate"] = cloud.LastAttempted.Time.Format("3:04 PM _2 Jan 2006")
+		}
+	}
+
+	data := map[string]interface{}{
+		"websub":     websubData,
+		"rsscloud":   cloudData,
+		"Message":    message,
+		"OwnerName":  account.DisplayName,
+		"streampath": account.Path(),
+		"CsrfToken":  csrfTokenFor(r),
+	}
+	html := mustache.RenderFile("html/subscribers.html", data)
+	w.Write([]byte(html))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+)
+
+const SWEEPER_INTERVAL = time.Hour
+
+// SweepExpired deletes the hub and rssCloud subscriptions that ran out, so the
+// tables we look through for every post only hold live ones, and audit events
+// older than we keep them.
+func SweepExpired() {
+	count, err := DeleteExpiredSubscriptions()
+	if err != nil {
+		logr.Errln("Error deleting expired hub subscriptions:", err.Error())
+	} else if count > 0 {
+		logr.Debugln("Deleted", count, "expired hub subscriptions")
+	}
+
+	count, err = DeleteExpiredRssClouds()
+	if err != nil {
+		logr.Errln("Error deleting expired rssCloud subscriptions:", err.Error())
+	} else if count > 0 {
+		logr.Debugln("Deleted", count, "expired rssCloud subscriptions")
+	}
+
+	count, err = DeleteOldAuditEvents()
+	if err != nil {
+		logr.Errln("Error deleting old audit events:", err.Error())
+	} else if count > 0 {
+		logr.Debugln("Deleted", count, "old audit events")
+	}
+}
+
+// RunSweeper sweeps out expired subscriptions every so often until stopping
+// is closed.
+func RunSweeper(stopping <-chan struct{}) {
+	for {
+		SweepExpired()
+		select {
+		case <-stopping:
+			return
+		case <-time.After(SWEEPER_INTERVAL):
+		}
+	}
+}
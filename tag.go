@@ -0,0 +1,115 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const MAX_TAG_LENGTH = 100
+
+type Tag struct {
+	Id     int64
+	PostId int64
+	Name   string
+}
+
+func NewTag() *Tag {
+	return &Tag{0, 0, ""}
+}
+
+func (t *Tag) Save() error {
+	if t.Id == 0 {
+		return db.Insert(t)
+	}
+	_, err := db.Update(t)
+	return err
+}
+
+func (t *Tag) Permalink() string {
+	return "/tag/" + t.Name
+}
+
+var htmlTagRE = regexp.MustCompile(`<[^>]*>`)
+
+// A hashtag can't follow a word character, or it's probably part of a URL or
+// an HTML entity like &#39;.
+var hashtagRE = regexp.MustCompile(`(?:^|[^\pL\pN_&#/])#([\pL\pN_]+)`)
+var digitsRE = regexp.MustCompile(`^[0-9]+$`)
+
+func NormalizeTag(name string) string {
+	name = strings.ToLower(strings.TrimPrefix(name, "#"))
+	for utf8.RuneCountInString(name) > MAX_TAG_LENGTH {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// HashtagsInHtml finds the #hashtags in the text of the given post HTML.
+func HashtagsInHtml(html string) []string {
+	text := htmlTagRE.ReplaceAllString(html, " ")
+	matches := hashtagRE.FindAllStringSubmatch(text, -1)
+
+	tags := make([]string, 0, len(matches))
+	for _, match := range matches {
+		// Like Twitter, don't count "#1" as a tag.
+		if digitsRE.MatchString(match[1]) {
+			continue
+		}
+		tags = append(tags, match[1])
+	}
+	return tags
+}
+
+// SaveTags replaces the post's tags with the hashtags in its HTML, plus any
+// extra tags given.
+func (p *Post) SaveTags(extra []string) error {
+	_, err := db.Exec("DELETE FROM tag WHERE postId = $1", p.Id)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range append(HashtagsInHtml(p.Html), extra...) {
+		name = NormalizeTag(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		tag := NewTag()
+		tag.PostId = p.Id
+		tag.Name = name
+		err = tag.Save()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Post) Tags() ([]*Tag, error) {
+	rows, err := db.Select(Tag{},
+		"SELECT id, postId, name FROM tag WHERE postId = $1 ORDER BY name ASC",
+		p.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]*Tag, len(rows))
+	for i, row := range rows {
+		tags[i] = row.(*Tag)
+	}
+	return tags, nil
+}
+
+func PostsWithTag(accountId int64, name string, count int) ([]*Post, error) {
+	rows, err := db.Select(Post{},
+		"SELECT p.id, p.authorId, p.accountId, p.url, p.html, p.posted, p.created, p.status FROM post p, tag t WHERE p.id = t.postId AND t.name = $1 AND p.accountId = $2 AND p.deleted IS NULL AND p.status = 'published' ORDER BY p.posted DESC LIMIT $3",
+		name, accountId, count)
+	if err != nil {
+		return nil, err
+	}
+	return postsForRows(rows), nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// AUTH_FREE_FAILURES is how many times in a row someone can get the
+	// password wrong before they have to wait to try again.
+	AUTH_FREE_FAILURES = 3
+	AUTH_MAX_BACKOFF   = 15 * time.Minute
+	// AUTH_FAILURE_MEMORY is how long we remember failures for.
+	AUTH_FAILURE_MEMORY = 24 * time.Hour
+	// AUTH_MAX_TRACKED is how many names and addresses we remember failures
+	// for at once, forgetting the least recent past that.
+	AUTH_MAX_TRACKED = 10000
+)
+
+type authFailures struct {
+	Count       int
+	Last        time.Time
+	LockedUntil time.Time
+	// Reported is whether we've recorded refusing a login during the
+	// current lockout.
+	Reported bool
+}
+
+// authThrottle counts recent failed logins, both by the client's address and
+// by the account name tried from that address. Failures from one address
+// don't lock out logins to the account from anywhere else, so no one can keep
+// an account holder out by getting their password wrong on purpose.
+var authThrottle = struct {
+	sync.Mutex
+	failures map[string]*authFailures
+}{failures: make(map[string]*authFailures)}
+
+func authThrottleKeys(name, addr string) []string {
+	return []string{"account:" + name + " addr:" + addr, "addr:" + addr}
+}
+
+// backoffForFailures returns how long to lock out logins after count
+// failures in a row, doubling with every failure past the free ones.
+func backoffForFailures(count int) time.Duration {
+	if count <= AUTH_FREE_FAILURES {
+		return 0
+	}
+	backoff := time.Duration(math.Pow(2, float64(count-AUTH_FREE_FAILURES-1))) * time.Second
+	if backoff <= 0 || backoff > AUTH_MAX_BACKOFF {
+		backoff = AUTH_MAX_BACKOFF
+	}
+	return backoff
+}
+
+// authLockedFor returns how much longer logins for the account from the
+// address are locked out, and whether this is the first refusal of the
+// lockout (so worth recording).
+func authLockedFor(name, addr string) (time.Duration, bool) {
+	authThrottle.Lock()
+	defer authThrottle.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	first := false
+	for _, key := range authThrottleKeys(name, addr) {
+		failures, ok := authThrottle.failures[key]
+		if !ok || !failures.LockedUntil.After(now) {
+			continue
+		}
+		if failures.LockedUntil.Sub(now) > wait {
+			wait = failures.LockedUntil.Sub(now)
+		}
+		if !failures.Reported {
+			failures.Reported = true
+			first = true
+		}
+	}
+	return wait, first
+}
+
+// forgetAuthFailures drops failures we no longer need to remember, then the
+// least recent ones if we're still remembering too many. The caller must
+// hold authThrottle's lock.
+func forgetAuthFailures(now time.Time) {
+	for key, failures := range authThrottle.failures {
+		if now.Sub(failures.Last) > AUTH_FAILURE_MEMORY && now.After(failures.LockedUntil) {
+			delete(authThrottle.failures, key)
+		}
+	}
+
+	for len(authThrottle.failures) >= AUTH_MAX_TRACKED {
+		oldestKey, oldest := "", now
+		for key, failures := range authThrottle.failures {
+			if !failures.Last.After(oldest) {
+				oldestKey, oldest = key, failures.Last
+			}
+		}
+		delete(authThrottle.failures, oldestKey)
+	}
+}
+
+func recordAuthFailure(name, addr string) {
+	authThrottle.Lock()
+	defer authThrottle.Unlock()
+
+	now := time.Now()
+	forgetAuthFailures(now)
+
+	for _, key := range authThrottleKeys(name, addr) {
+		failures, ok := authThrottle.failures[key]
+		if !ok {
+			failures = &authFailures{}
+			authThrottle.failures[key] = failures
+		}
+		failures.Count++
+		failures.Last = now
+		failures.LockedUntil = now.Add(backoffForFailures(failures.Count))
+		failures.Reported = false
+	}
+}
+
+func clearAuthFailures(name, addr string) {
+	authThrottle.Lock()
+	defer authThrottle.Unlock()
+
+	for _, key := range authThrottleKeys(name, addr) {
+		delete(authThrottle.failures, key)
+	}
+}
+
+// CheckPassword checks the name and password a client gave, returning the
+// account if they match. Clients that get it wrong too often are locked out
+// for a while, in which case wait is how long they should wait to try again.
+// Once the client is fully logged in, clear its failures with
+// clearAuthFailures.
+func CheckPassword(r *http.Request, name, pass string) (account *Account, wait time.Duration, err error) {
+	addr := clientAddr(r)
+	wait, first := authLockedFor(name, addr)
+	if wait > 0 {
+		logr.Errln("Refused login for", name, "from", addr, "as it's locked out for another", wait)
+		if first {
+			RecordAuditEvent(name, addr, AUDIT_LOCKED_OUT)
+		}
+		return nil, wait, nil
+	}
+
+	account, err = AccountByName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if account == nil || !account.HasPassword(pass) {
+		logr.Errln("Failed login for", name, "from", addr)
+		recordAuthFailure(name, addr)
+		RecordAuditEvent(name, addr, AUDIT_LOGIN_FAILED)
+		return nil, 0, nil
+	}
+
+	return account, 0, nil
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	setRetryAfter(w, wait)
+	http.Error(w, "too many failed login attempts; try again later", http.StatusTooManyRequests)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CERT_CHECK_INTERVAL is how often we look to see if the certificate files
+// have changed.
+const CERT_CHECK_INTERVAL = 10 * time.Second
+
+// CertReloader serves a TLS certificate from files on disk, loading it again
+// whenever the files change, so renewed certificates are used without a
+// restart.
+type CertReloader struct {
+	sync.Mutex
+	CertFile    string
+	KeyFile     string
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastChecked time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	err := reloader.load()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func fileModTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// load reads the certificate and key if they changed since we last did.
+func (c *CertReloader) load() error {
+	certModTime, err := fileModTime(c.CertFile)
+	if err != nil {
+		return err
+	}
+	keyModTime, err := fileModTime(c.KeyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && certModTime.Equal(c.certModTime) && keyModTime.Equal(c.keyModTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.certModTime, c.keyModTime = certModTime, keyModTime
+	logr.Debugln("Loaded TLS certificate from", c.CertFile)
+	return nil
+}
+
+// GetCertificate returns the current certificate, for use in a tls.Config. If
+// the files changed but can't be loaded (say, as they're only half written),
+// it keeps serving the last good certificate.
+func (c *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if time.Since(c.lastChecked) >= CERT_CHECK_INTERVAL {
+		c.lastChecked = time.Now()
+		err := c.load()
+		if err != nil {
+			logr.Errln("Error reloading TLS certificate", c.CertFile, ":", err.Error())
+		}
+	}
+	return c.cert, nil
+}
+
+// redirectToHttps makes a handler that sends browsers to the same page on
+// the HTTPS server listening on tlsPort.
+func redirectToHttps(tlsPort int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var target string
+		if strings.HasPrefix(siteBaseUrl, "https:") {
+			target = strings.TrimRight(siteBaseUrl, "/") + r.URL.RequestURI()
+		} else {
+			host := stripPort(r.Host)
+			if host == "" {
+				http.Error(w, "a Host header is required", http.StatusBadRequest)
+				return
+			}
+			if tlsPort != 443 {
+				host = net.JoinHostPort(host, strconv.Itoa(tlsPort))
+			} else if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+			target = "https://" + host + r.URL.RequestURI()
+		}
+
+		status := http.StatusMovedPermanently
+		if !isSafeMethod(r.Method) {
+			// Keep the method and body of posts.
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, target, status)
+	}
+}
+
+// newTlsServer makes a server for HTTPS on port with the reloader's
+// certificate.
+func newTlsServer(port int, reloader *CertReloader) *http.Server {
+	return &http.Server{
+		Addr: fmt.Sprintf(":%d", port),
+		TLSConfig: &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		},
+	}
+}
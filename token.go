@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/bmizerany/pq"
+	"strings"
+	"time"
+)
+
+// TOKEN_SCOPES are the scopes a token can be issued for. Reading drafts,
+// deleted posts and post sources takes the read scope.
+var TOKEN_SCOPES = []string{"create", "update", "delete", "undelete", "read"}
+
+// RandomToken returns a URL-safe random string made from n random bytes.
+func RandomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// HashToken returns the hash of a token by which we store it, so the token
+// itself isn't kept in the database.
+func HashToken(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+// NormalizeScope returns the known scopes among the space separated scopes.
+func NormalizeScope(scope string) string {
+	scopes := make([]string, 0, len(TOKEN_SCOPES))
+	requested := strings.Fields(scope)
+	for _, known := range TOKEN_SCOPES {
+		for _, req := range requested {
+			if req == known {
+				scopes = append(scopes, known)
+				break
+			}
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+type Token struct {
+	Id        int64
+	AccountId int64
+	TokenHash string
+	Name      string
+	Scope     string
+	Created   time.Time
+	LastUsed  pq.NullTime
+	Revoked   pq.NullTime
+}
+
+// NewToken makes a token for the account, returning the token and its secret
+// value. The value is only available now, as only its hash is saved.
+func NewToken(account *Account, name, scope string) (*Token, string, error) {
+	value, err := RandomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	scope = NormalizeScope(scope)
+	if scope == "" {
+		return nil, "", fmt.Errorf("Refusing to make a token that grants no scope")
+	}
+	token := &Token{0, account.Id, HashToken(value), name, scope, time.Now().UTC(),
+		pq.NullTime{time.Unix(0, 0), false}, pq.NullTime{time.Unix(0, 0), false}}
+	return token, value, nil
+}
+
+func (t *Token) Save() error {
+	if t.Id == 0 {
+		return db.Insert(t)
+	}
+	_, err := db.Update(t)
+	return err
+}
+
+// HasScope checks the token grants the scope. No token grants the empty
+// scope, so asking for it only lets in account holders themselves.
+func (t *Token) HasScope(scope string) bool {
+	if scope == "" {
+		return false
+	}
+	for _, tokenScope := range strings.Fields(t.Scope) {
+		if tokenScope == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Token) MarkUsed() error {
+	t.LastUsed = pq.NullTime{time.Now().UTC(), true}
+	return t.Save()
+}
+
+func (t *Token) Revoke() error {
+	t.Revoked = pq.NullTime{time.Now().UTC(), true}
+	return t.Save()
+}
+
+func (t *Token) CreatedDate() string {
+	return t.Created.Format("_2 Jan 2006")
+}
+
+func (t *Token) LastUsedDate() string {
+	if !t.LastUsed.Valid {
+		return "never"
+	}
+	return t.LastUsed.Time.Format("_2 Jan 2006")
+}
+
+func tokensForRows(rows []interface{}) []*Token {
+	tokens := make([]*Token, len(rows))
+	for i, row := range rows {
+		tokens[i] = row.(*Token)
+	}
+	return tokens
+}
+
+// TokenByValue finds the unrevoked token with the given secret value.
+func TokenByValue(value string) (*Token, error) {
+	rows, err := db.Select(Token{},
+		"SELECT id, accountId, tokenHash, name, scope, created, lastUsed, revoked FROM token WHERE tokenHash = $1 AND revoked IS NULL",
+		HashToken(value))
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].(*Token), nil
+}
+
+func TokenById(accountId, id int64) (*Token, error) {
+	rows, err := db.Select(Token{},
+		"SELECT id, accountId, tokenHash, name, scope, created, lastUsed, revoked FROM token WHERE accountId = $1 AND id = $2",
+		accountId, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].(*Token), nil
+}
+
+func ActiveTokensForAccount(accountId int64) ([]*Token, error) {
+	rows, err := db.Select(Token{},
+		"SELECT id, accountId, tokenHash, name, scope, created, lastUsed, revoked FROM token WHERE accountId = $1 AND revoked IS NULL ORDER BY created DESC",
+		accountId)
+	if err != nil {
+		return nil, err
+	}
+	return tokensForRows(rows), nil
+}
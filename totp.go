@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/bmizerany/pq"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	TOTP_DIGITS = 6
+	TOTP_PERIOD = 30
+	// TOTP_SKEW is how many periods either side of now we accept codes from,
+	// in case the phone's clock is a little off.
+	TOTP_SKEW           = 1
+	TOTP_ISSUER         = "cares"
+	RECOVERY_CODE_COUNT = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type Totp struct {
+	Id        int64
+	AccountId int64
+	Secret    string
+	LastStep  int64
+	Created   time.Time
+}
+
+type RecoveryCode struct {
+	Id        int64
+	AccountId int64
+	CodeHash  string
+	Used      pq.NullTime
+}
+
+// NewTotp makes a new random TOTP secret for the account.
+func NewTotp(account *Account) (*Totp, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &Totp{0, account.Id, totpEncoding.EncodeToString(secret), 0, time.Now().UTC()}, nil
+}
+
+func (t *Totp) Save() error {
+	if t.Id == 0 {
+		return db.Insert(t)
+	}
+	_, err := db.Update(t)
+	return err
+}
+
+// ProvisioningUri returns the otpauth URI authenticator apps use to set up
+// codes for the account.
+func (t *Totp) ProvisioningUri(account *Account) string {
+	label := url.PathEscape(TOTP_ISSUER + ":" + account.Name)
+	query := url.Values{}
+	query.Set("secret", t.Secret)
+	query.Set("issuer", TOTP_ISSUER)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprintf("%d", TOTP_DIGITS))
+	query.Set("period", fmt.Sprintf("%d", TOTP_PERIOD))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// hotpCode computes the RFC 4226 code for the given counter.
+func hotpCode(secret []byte, counter int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%modulus)
+}
+
+// HasCode checks the code is right for around now, and hasn't been used
+// before. Using a code uses it up along with any earlier ones, so save the
+// Totp afterward.
+func (t *Totp) HasCode(code string) bool {
+	secret, err := totpEncoding.DecodeString(t.Secret)
+	if err != nil {
+		return false
+	}
+
+	code = strings.Replace(code, " ", "", -1)
+	now := time.Now().Unix() / TOTP_PERIOD
+	for step := now - TOTP_SKEW; step <= now+TOTP_SKEW; step++ {
+		if step <= t.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotpCode(secret, step)), []byte(code)) == 1 {
+			t.LastStep = step
+			return true
+		}
+	}
+	return false
+}
+
+func TotpForAccount(accountId int64) (*Totp, error) {
+	rows, err := db.Select(Totp{},
+		"SELECT id, accountId, secret, lastStep, created FROM totp WHERE accountId = $1",
+		accountId)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].(*Totp), nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, " ", "", -1)
+	return strings.Replace(code, "-", "", -1)
+}
+
+// MakeRecoveryCodes replaces the account's recovery codes with new ones,
+// returning them. Like tokens, only their hashes are saved.
+func MakeRecoveryCodes(account *Account) ([]string, error) {
+	codes := make([]string, RECOVERY_CODE_COUNT)
+	rows := make([]interface{}, RECOVERY_CODE_COUNT)
+	for i := range codes {
+		buf := make([]byte, 5)
+		_, err := rand.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(buf))
+		codes[i] = code[:4] + "-" + code[4:]
+		rows[i] = &RecoveryCode{0, account.Id, HashToken(normalizeRecoveryCode(code)), pq.NullTime{time.Unix(0, 0), false}}
+	}
+
+	trans, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	_, err = trans.Exec("DELETE FROM recoverycode WHERE accountId = $1", account.Id)
+	if err == nil {
+		err = trans.Insert(rows...)
+	}
+	if err != nil {
+		trans.Rollback()
+		return nil, err
+	}
+	err = trans.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode checks the code is one of the account's unused recovery
+// codes, and if so uses it up.
+func UseRecoveryCode(accountId int64, code string) (bool, error) {
+	result, err := db.Exec("UPDATE recoverycode SET used = $1 WHERE accountId = $2 AND codeHash = $3 AND used IS NULL",
+		time.Now().UTC(), accountId, HashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// CheckSecondFactor checks the code is the account's current TOTP code or one
+// of its recovery codes. Wrong codes count as failed logins.
+func CheckSecondFactor(r *http.Request, account *Account, totp *Totp, code string) (bool, error) {
+	addr := clientAddr(r)
+
+	var err error
+	ok := totp.HasCode(code)
+	if ok {
+		err = totp.Save()
+		if err != nil {
+			return false, err
+		}
+	} else if code != "" {
+		ok, err = UseRecoveryCode(account.Id, code)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			logr.Errln("Recovery code used to log in to", account.Name, "from", addr)
+			RecordAuditEvent(account.Name, addr, AUDIT_RECOVERY_CODE)
+		}
+	}
+
+	if !ok {
+		logr.Errln("Failed two-factor code for", account.Name, "from", addr)
+		recordAuthFailure(account.Name, addr)
+		RecordAuditEvent(account.Name, addr, AUDIT_CODE_FAILED)
+	}
+	return ok, nil
+}
+
+// EnrolTotp sets up two-factor authentication for the account interactively,
+// replacing any it had before.
+func EnrolTotp(account *Account) {
+	totp, err := NewTotp(account)
+	if err != nil {
+		logr.Errln("Error making two-factor secret:", err.Error())
+		return
+	}
+
+	Say("Add this account to your authenticator app with this URI (or type in the secret by hand):")
+	Say()
+	Say("    ", totp.ProvisioningUri(account))
+	Say()
+	Say("Secret:", totp.Secret)
+	Say()
+
+	for {
+		code := Prompt("Enter the code the app shows to confirm: ")
+		if code == "" {
+			Say("Not setting up two-factor authentication.")
+			return
+		}
+		if totp.HasCode(code) {
+			break
+		}
+		Say("That code didn't match. Try again, or enter nothing to give up.")
+	}
+
+	existing, err := TotpForAccount(account.Id)
+	if err != nil {
+		logr.Errln("Error looking for existing two-factor secret:", err.Error())
+		return
+	}
+	if existing != nil {
+		existing.Secret = totp.Secret
+		existing.LastStep = totp.LastStep
+		existing.Created = totp.Created
+		totp = existing
+	}
+	err = totp.Save()
+	if err != nil {
+		logr.Errln("Error saving two-factor secret:", err.Error())
+		return
+	}
+
+	codes, err := MakeRecoveryCodes(account)
+	if err != nil {
+		logr.Errln("Error making recovery codes:", err.Error())
+		return
+	}
+	Say()
+	Say("Two-factor authentication is on. If you lose your authenticator, you can log in")
+	Say("with one of these recovery codes instead. Each works only once, so keep them safe:")
+	Say()
+	for _, code := range codes {
+		Say("    ", code)
+	}
+}
+
+// ManageTotp turns two-factor authentication on (again) or off for the named
+// account.
+func ManageTotp(name string, disable bool) {
+	account, err := AccountByName(name)
+	if err != nil {
+		logr.Errln("Error loading account", name, ":", err.Error())
+		return
+	}
+	if account == nil {
+		logr.Errln("No such account", name)
+		return
+	}
+
+	if !disable {
+		EnrolTotp(account)
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM totp WHERE accountId = $1", account.Id)
+	if err == nil {
+		_, err = db.Exec("DELETE FROM recoverycode WHERE accountId = $1", account.Id)
+	}
+	if err != nil {
+		logr.Errln("Error turning off two-factor authentication for", name, ":", err.Error())
+		return
+	}
+	Say("Two-factor authentication is off for", name)
+}
@@ -1,15 +1,13 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/hoisie/mustache"
 	"github.com/moovweb/gokogiri/html"
 	"github.com/moovweb/gokogiri/xml"
-	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -17,9 +15,9 @@ import (
 	"time"
 )
 
-func authedForHeader(authHeader string) (bool, error) {
+func authedForHeader(r *http.Request, authHeader string) (*Account, time.Duration, error) {
 	if !strings.HasPrefix(authHeader, "Basic ") {
-		return false, nil
+		return nil, 0, nil
 	}
 	logr.Debugln("Yay, client gave a Basic auth header")
 
@@ -27,83 +25,275 @@ func authedForHeader(authHeader string) (bool, error) {
 	if err != nil {
 		logr.Debugln("Oops, error decoding the client's Basic auth header:", err.Error())
 		// but report it as Unauthorized, not an error
-		return false, nil
+		return nil, 0, nil
 	}
 	userpassParts := strings.SplitN(string(userpass), ":", 2)
+	if len(userpassParts) < 2 {
+		logr.Debugln("Oops, the client's Basic auth header has no password")
+		return nil, 0, nil
+	}
 	username, pass := userpassParts[0], userpassParts[1]
 
-	account, err := AccountByName(username)
-	if err == sql.ErrNoRows {
-		logr.Debugln("No such account %s", username)
-		return false, nil
-	} else if err != nil {
-		return false, err
+	account, wait, err := CheckPassword(r, username, pass)
+	if account == nil || err != nil {
+		return nil, wait, err
+	}
+
+	// Basic auth can't ask for a code, so accounts with two-factor
+	// authentication have to log in with a session instead.
+	totp, err := TotpForAccount(account.Id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if totp != nil {
+		logr.Debugln("Refusing Basic auth for", username, "as it has two-factor authentication")
+		return nil, 0, nil
 	}
 
-	return account.HasPassword(pass), nil
+	clearAuthFailures(username, clientAddr(r))
+	return account, 0, nil
 }
 
-func IsAuthed(w http.ResponseWriter, r *http.Request) (authed bool) {
+// AccountAuthedInPerson returns the account whose own credentials the request
+// carries, by login session or password rather than a token, for pages that
+// hand out access. Changes made through a login session must carry its CSRF
+// token. If there's no such account, it writes an error and returns nil.
+func AccountAuthedInPerson(w http.ResponseWriter, r *http.Request) *Account {
+	session, err := SessionForRequest(r)
+	if err != nil {
+		logr.Errln("Error loading session:", err.Error())
+		http.Error(w, "error loading auth information", http.StatusInternalServerError)
+		return nil
+	}
+	if session != nil {
+		if !isSafeMethod(r.Method) && !session.HasCsrfToken(r) {
+			http.Error(w, "missing or incorrect CSRF token", http.StatusForbidden)
+			return nil
+		}
+		account, err := AccountById(session.AccountId)
+		if err != nil || account == nil {
+			logr.Errln("Error loading account", session.AccountId, "for session", session.Id)
+			http.Error(w, "error loading auth information", http.StatusInternalServerError)
+			return nil
+		}
+		return account
+	}
+
 	authHeader := r.Header.Get("Authorization")
-	authed, err := authedForHeader(authHeader)
+	account, wait, err := authedForHeader(r, authHeader)
 	if err != nil {
 		logr.Errln("Error checking auth information:", err.Error())
 		http.Error(w, "error loading auth information", http.StatusInternalServerError)
-	} else if !authed {
+	} else if wait > 0 {
+		writeTooManyAttempts(w, wait)
+	} else if account == nil && authHeader == "" && r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+	} else if account == nil {
 		w.Header().Set("WWW-Authenticate", "Basic realm=\"cares\"")
 		http.Error(w, "authorization required", http.StatusUnauthorized)
 	}
-	return
+	return account
 }
 
-func WriteRssForPosts(w http.ResponseWriter, r *http.Request, posts []*Post, titleFormat string) (err error) {
-	var host string
-	var port string
-	if strings.Contains(r.Host, ":") {
-		host, port, err = net.SplitHostPort(r.Host)
-		if err != nil {
-			return
+// AccountLoggedIn returns the account whose login session the request is
+// from, for pages where a cross-site form mustn't be able to act for someone.
+// Browsers send remembered passwords along with such forms by themselves, so
+// unlike AccountAuthedInPerson it won't take a password, and changes must
+// carry the session's CSRF token. If there's no such account, it writes an
+// error and returns nil.
+func AccountLoggedIn(w http.ResponseWriter, r *http.Request) *Account {
+	session, err := SessionForRequest(r)
+	if err != nil {
+		logr.Errln("Error loading session:", err.Error())
+		http.Error(w, "error loading auth information", http.StatusInternalServerError)
+		return nil
+	}
+	if session == nil {
+		if r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		} else {
+			http.Error(w, "log in to do that", http.StatusForbidden)
 		}
-	} else {
-		host = r.Host
-		// TODO: set port appropriately if we're on HTTPS
-		port = "80"
+		return nil
 	}
+	return AccountAuthedInPerson(w, r)
+}
+
+// IsAuthed checks the request carries an account's credentials or a token
+// that can read its posts.
+func IsAuthed(w http.ResponseWriter, r *http.Request) bool {
+	return AccountAuthedFor(w, r, "read") != nil
+}
+
+// IsAuthedFor checks the request carries an account's credentials or a
+// bearer token granting the given scope.
+func IsAuthedFor(w http.ResponseWriter, r *http.Request, scope string) bool {
+	return AccountAuthedFor(w, r, scope) != nil
+}
 
-	owner := AccountForOwner()
-	firstPost, err := FirstPost()
+// IsAuthedForPost is like IsAuthedFor, but the account must also be the one
+// whose stream the post is in.
+func IsAuthedForPost(w http.ResponseWriter, r *http.Request, post *Post, scope string) bool {
+	account := AccountAuthedFor(w, r, scope)
+	if account == nil {
+		return false
+	}
+	if account.Id != post.AccountId {
+		http.Error(w, "that post is someone else's", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// bearerTokenValue returns the bearer token the request carries in its
+// Authorization header or (as Micropub clients may send it) its form, if any.
+func bearerTokenValue(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimSpace(authHeader[len("Bearer "):])
+	}
+	if authHeader == "" {
+		return r.PostFormValue("access_token")
+	}
+	return ""
+}
+
+// AccountAuthedFor returns the account whose credentials the request carries,
+// or that granted it a bearer token with the given scope. If there's no such
+// account, it writes an error and returns nil.
+func AccountAuthedFor(w http.ResponseWriter, r *http.Request, scope string) *Account {
+	value := bearerTokenValue(r)
+	if value == "" {
+		return AccountAuthedInPerson(w, r)
+	}
+
+	token, err := TokenByValue(value)
 	if err != nil {
-		return
+		logr.Errln("Error checking bearer token:", err.Error())
+		http.Error(w, "error loading auth information", http.StatusInternalServerError)
+		return nil
+	}
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="cares", error="invalid_token"`)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return nil
+	}
+	if !token.HasScope(scope) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="cares", error="insufficient_scope", scope="%s"`, scope))
+		http.Error(w, "token does not grant scope "+scope, http.StatusForbidden)
+		return nil
+	}
+
+	account, err := AccountById(token.AccountId)
+	if err != nil || account == nil {
+		logr.Errln("Error loading account", token.AccountId, "for token", token.Id)
+		http.Error(w, "error loading auth information", http.StatusInternalServerError)
+		return nil
+	}
+
+	err = token.MarkUsed()
+	if err != nil {
+		logr.Errln("Error noting use of token", token.Id, ":", err.Error())
+		// but continue
+	}
+	return account
+}
+
+// accountKey is the context key under which requests for an account's stream
+// carry the account.
+type accountKey struct{}
+
+// accountForRequest returns the account whose stream the request is for.
+func accountForRequest(r *http.Request) *Account {
+	if account, ok := r.Context().Value(accountKey{}).(*Account); ok {
+		return account
+	}
+	return AccountForOwner()
+}
+
+// setHubLinks adds the WebSub discovery headers for a feed subscribers can
+// subscribe to at our hub.
+func setHubLinks(w http.ResponseWriter, baseurl, selfUrl string) {
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="hub"`, hubUrl(baseurl)))
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="self"`, selfUrl))
+}
+
+// FEED_LANGUAGE is the language our feeds say posts are in.
+const FEED_LANGUAGE = "en-us"
+
+// rssCloudElement returns the attributes of the <cloud> element advertising
+// our rssCloud endpoint, or nil if there's no canonical base URL configured to
+// advertise it at. Feeds can be cached, so this never comes from the request's
+// Host header.
+func rssCloudElement() (map[string]interface{}, error) {
+	if siteBaseUrl == "" {
+		return nil, nil
+	}
+	host, port, err := siteHostPort(siteBaseUrl)
+	if err != nil {
+		return nil, err
 	}
+	return map[string]interface{}{
+		"domain":            host,
+		"port":              port,
+		"path":              "/rssCloud",
+		"registerProcedure": "cloud.notify",
+		"protocol":          RSSCLOUD_XML_RPC,
+	}, nil
+}
 
-	// TODO: somehow determine if we're on HTTPS or no?
-	baseurlUrl := url.URL{"http", "", nil, r.Host, "/", "", ""}
-	baseurl := strings.TrimRight(baseurlUrl.String(), "/")
+func RssForPosts(baseurl string, account *Account, posts []*Post, titleFormat string) (string, error) {
+	firstPost, err := FirstPost(account.Id)
+	if err != nil {
+		return "", err
+	}
 
 	data := map[string]interface{}{
 		"posts":     posts,
-		"OwnerName": owner.DisplayName,
-		"Title":     fmt.Sprintf(titleFormat, owner.DisplayName),
+		"OwnerName": account.DisplayName,
+		"Title":     fmt.Sprintf(titleFormat, account.DisplayName),
 		"baseurl":   baseurl,
-		"host":      host,
-		"port":      port,
-		"FirstPost": firstPost,
+		"streamurl": account.StreamUrl(baseurl),
+		"language":  FEED_LANGUAGE,
+	}
+	if firstPost != nil {
+		data["FirstPost"] = firstPost
+	}
+	// Only the owner's feed is served by our rssCloud.
+	if account.IsOwner() {
+		cloud, err := rssCloudElement()
+		if err != nil {
+			return "", err
+		}
+		if cloud != nil {
+			data["cloud"] = cloud
+		}
 	}
 	logr.Debugln("Rendering RSS with baseurl of", baseurl)
-	xml := mustache.RenderFile("html/rss.xml", data)
+	return mustache.RenderFile("html/rss.xml", data), nil
+}
+
+func WriteRssForPosts(w http.ResponseWriter, r *http.Request, posts []*Post, titleFormat string) error {
+	xml, err := RssForPosts(baseUrlFor(r), accountForRequest(r), posts, titleFormat)
+	if err != nil {
+		return err
+	}
 	w.Header().Set("Content-Type", "application/rss+xml")
 	w.Write([]byte(xml))
-	return
+	return nil
 }
 
 func rss(w http.ResponseWriter, r *http.Request) {
-	posts, err := RecentPosts(20)
+	account := accountForRequest(r)
+	posts, err := RecentPosts(account.Id, 20)
 	if err != nil {
 		logr.Errln("Error loading posts for RSS feed:", err.Error())
 		http.Error(w, "error finding recent posts", http.StatusInternalServerError)
 		return
 	}
 
+	baseurl := baseUrlFor(r)
+	setHubLinks(w, baseurl, account.StreamUrl(baseurl)+"/rss")
 	err = WriteRssForPosts(w, r, posts, "%s")
 	if err != nil {
 		logr.Errln("Error building RSS for recent posts:", err.Error())
@@ -141,36 +331,45 @@ func archive(w http.ResponseWriter, r *http.Request) {
 	}
 
 	archiveDate := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
-	posts, err := PostsOnDay(archiveDate)
+	account := accountForRequest(r)
+	posts, err := PostsOnDay(account.Id, archiveDate)
 	if err != nil {
 		logr.Errln("Error getting posts for day", archiveDate, "from database:", err.Error())
 		http.Error(w, "error finding posts for day", http.StatusInternalServerError)
 		return
 	}
 
-	err = WriteRssForPosts(w, r, posts, archiveDate.Format("%s for _2 Jan 2006"))
+	baseurl := baseUrlFor(r)
+	setHubLinks(w, baseurl, account.StreamUrl(baseurl)+archivePath(archiveDate))
+	err = WriteRssForPosts(w, r, posts, archiveTitleFormat(archiveDate))
 	if err != nil {
 		logr.Errln("Error generating RSS for date", archiveDate, ":", err.Error())
 		http.Error(w, "error generating rss for date", http.StatusInternalServerError)
 	}
 }
 
-func AtomForPosts(r *http.Request, posts []*Post, titleFormat string) string {
-	// TODO: somehow determine if we're on HTTPS or no?
-	baseurlUrl := url.URL{"http", "", nil, r.Host, "/", "", ""}
-	baseurl := strings.TrimRight(baseurlUrl.String(), "/")
+// archivePath returns the path of the archive feed for the day, relative to
+// the stream it's for.
+func archivePath(day time.Time) string {
+	return day.UTC().Format("/archive/2006/01/02/rss.xml")
+}
+
+func archiveTitleFormat(day time.Time) string {
+	return day.Format("%s for _2 Jan 2006")
+}
 
+func AtomForPosts(baseurl string, account *Account, posts []*Post, titleFormat string) string {
 	var lastPost *Post = nil
 	if len(posts) > 0 {
 		lastPost = posts[0]
 	}
 
-	owner := AccountForOwner()
 	data := map[string]interface{}{
 		"Posts":     posts,
-		"OwnerName": owner.DisplayName,
-		"Title":     fmt.Sprintf(titleFormat, owner.DisplayName),
+		"OwnerName": account.DisplayName,
+		"Title":     fmt.Sprintf(titleFormat, account.DisplayName),
 		"baseurl":   baseurl,
+		"streamurl": account.StreamUrl(baseurl),
 		"LastPost":  lastPost,
 	}
 	logr.Debugln("Rendering Atom with baseurl of", baseurl)
@@ -179,30 +378,78 @@ func AtomForPosts(r *http.Request, posts []*Post, titleFormat string) string {
 }
 
 func atom(w http.ResponseWriter, r *http.Request) {
-	posts, err := RecentPosts(20)
+	account := accountForRequest(r)
+	posts, err := RecentPosts(account.Id, 20)
 	if err != nil {
 		logr.Errln("Error loading posts for Atom feed:", err.Error())
 		http.Error(w, "error finding recent posts", http.StatusInternalServerError)
 		return
 	}
 
-	xml := AtomForPosts(r, posts, "%s")
+	baseurl := baseUrlFor(r)
+	xml := AtomForPosts(baseurl, account, posts, "%s")
+	setHubLinks(w, baseurl, account.StreamUrl(baseurl)+"/atom")
 	w.Header().Set("Content-Type", "application/atom+xml")
 	w.Write([]byte(xml))
 	return
 }
 
-func activity(w http.ResponseWriter, r *http.Request) {
-	// TODO: somehow determine if we're on HTTPS or no?
-	baseurlUrl := url.URL{"http", "", nil, r.Host, "/", "", ""}
-	baseurl := strings.TrimRight(baseurlUrl.String(), "/")
+func tagged(w http.ResponseWriter, r *http.Request) {
+	//  /tag/<name>/rss
+	// 0 1   2      3
+	pathParts := strings.SplitN(r.URL.Path, "/", 4)
+	name := NormalizeTag(pathParts[2])
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	account := accountForRequest(r)
+	posts, err := PostsWithTag(account.Id, name, 20)
+	if err != nil {
+		logr.Errln("Error loading posts tagged", name, ":", err.Error())
+		http.Error(w, "error finding tagged posts", http.StatusInternalServerError)
+		return
+	}
 
-	owner := AccountForOwner()
+	titleFormat := fmt.Sprintf("%%s: #%s", name)
+	if len(pathParts) == 4 {
+		switch pathParts[3] {
+		case "rss":
+			err = WriteRssForPosts(w, r, posts, titleFormat)
+			if err != nil {
+				logr.Errln("Error building RSS for tag", name, ":", err.Error())
+				http.Error(w, "error generating rss for tag", http.StatusInternalServerError)
+			}
+		case "atom":
+			xml := AtomForPosts(baseUrlFor(r), account, posts, titleFormat)
+			w.Header().Set("Content-Type", "application/atom+xml")
+			w.Write([]byte(xml))
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	data := map[string]interface{}{
+		"posts":      posts,
+		"Tag":        name,
+		"OwnerName":  account.DisplayName,
+		"streampath": account.Path(),
+	}
+	html := mustache.RenderFile("html/tag.html", data)
+	w.Write([]byte(html))
+}
+
+// ActivityStreamForPosts returns the JSON Activity Streams 1.0 stream of the
+// account's posts.
+func ActivityStreamForPosts(baseurl string, account *Account, items []*Post) ([]byte, error) {
+	streamurl := account.StreamUrl(baseurl)
 	actorData := map[string]interface{}{
 		"objectType":  "person",
-		"url":         baseurl + "/",
-		"id":          baseurl + "/",
-		"displayName": owner.DisplayName,
+		"url":         streamurl + "/",
+		"id":          streamurl + "/",
+		"displayName": account.DisplayName,
 		"image": map[string]interface{}{
 			"url":    baseurl + "/static/avatar-250.jpg",
 			"width":  250,
@@ -211,16 +458,9 @@ func activity(w http.ResponseWriter, r *http.Request) {
 	}
 	targetData := map[string]interface{}{
 		"objectType":  "blog",
-		"url":         baseurl + "/",
-		"id":          baseurl + "/",
-		"displayName": owner.DisplayName,
-	}
-
-	items, err := RecentPosts(20)
-	if err != nil {
-		logr.Errln("error finding recent posts for activity stream:", err.Error())
-		http.Error(w, "error finding recent activity", http.StatusInternalServerError)
-		return
+		"url":         streamurl + "/",
+		"id":          streamurl + "/",
+		"displayName": account.DisplayName,
 	}
 
 	itemData := make([]map[string]interface{}, len(items))
@@ -242,16 +482,130 @@ func activity(w http.ResponseWriter, r *http.Request) {
 	streamData := map[string]interface{}{
 		"items": itemData,
 	}
+	return json.Marshal(streamData)
+}
+
+func activity(w http.ResponseWriter, r *http.Request) {
+	account := accountForRequest(r)
+	items, err := RecentPosts(account.Id, 20)
+	if err != nil {
+		logr.Errln("error finding recent posts for activity stream:", err.Error())
+		http.Error(w, "error finding recent activity", http.StatusInternalServerError)
+		return
+	}
 
-	streamBytes, err := json.Marshal(streamData)
+	baseurl := baseUrlFor(r)
+	streamBytes, err := ActivityStreamForPosts(baseurl, account, items)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	setHubLinks(w, baseurl, account.StreamUrl(baseurl)+"/activity")
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(streamBytes)
 }
 
+func jsonFeed(w http.ResponseWriter, r *http.Request) {
+	baseurl := baseUrlFor(r)
+	account := accountForRequest(r)
+
+	var posts []*Post
+	var err error
+	before := r.FormValue("before")
+	if before != "" {
+		var beforeTime time.Time
+		beforeTime, err = time.Parse(time.RFC3339, before)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid timestamp %s", before), http.StatusBadRequest)
+			return
+		}
+		posts, err = PostsBefore(account.Id, beforeTime, 20)
+	} else {
+		posts, err = RecentPosts(account.Id, 20)
+	}
+	if err != nil {
+		logr.Errln("Error loading posts for JSON feed:", err.Error())
+		http.Error(w, "error finding recent posts", http.StatusInternalServerError)
+		return
+	}
+
+	feedBytes, err := JsonFeedForPosts(baseurl, account, posts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if before == "" {
+		setHubLinks(w, baseurl, account.StreamUrl(baseurl)+"/feed.json")
+	}
+	w.Header().Set("Content-Type", "application/feed+json")
+	w.Write(feedBytes)
+}
+
+// JsonFeedForPosts returns the JSON Feed of the account's posts, linking to
+// the next page if it's a full one.
+func JsonFeedForPosts(baseurl string, account *Account, posts []*Post) ([]byte, error) {
+	streamurl := account.StreamUrl(baseurl)
+	ownerData := map[string]interface{}{
+		"name":   account.DisplayName,
+		"url":    streamurl + "/",
+		"avatar": baseurl + "/static/avatar-250.jpg",
+	}
+
+	itemData := make([]map[string]interface{}, len(posts))
+	for i, post := range posts {
+		permalink := post.AbsolutePermalink(baseurl)
+		item := map[string]interface{}{
+			"id":             permalink,
+			"url":            permalink,
+			"content_html":   post.Html,
+			"date_published": post.PostedRFC3339(),
+		}
+
+		if !post.AuthorIsOwner() {
+			author, err := post.Author()
+			if err != nil {
+				logr.Errln("Error loading author", post.AuthorId, "for JSON feed item", post.Id, ":", err.Error())
+				// but continue
+			} else {
+				item["authors"] = []map[string]interface{}{
+					{"name": author.Name, "url": author.Url},
+				}
+			}
+		}
+
+		tags, err := post.Tags()
+		if err != nil {
+			logr.Errln("Error loading tags for JSON feed item", post.Id, ":", err.Error())
+			// but continue
+		} else if len(tags) > 0 {
+			tagNames := make([]string, len(tags))
+			for j, tag := range tags {
+				tagNames[j] = tag.Name
+			}
+			item["tags"] = tagNames
+		}
+
+		itemData[i] = item
+	}
+
+	feedData := map[string]interface{}{
+		"version":       "https://jsonfeed.org/version/1.1",
+		"title":         account.DisplayName,
+		"home_page_url": streamurl + "/",
+		"feed_url":      streamurl + "/feed.json",
+		"icon":          baseurl + "/static/avatar-250.jpg",
+		"authors":       []map[string]interface{}{ownerData},
+		"language":      FEED_LANGUAGE,
+		"items":         itemData,
+	}
+	if len(posts) == 20 {
+		// Use nanoseconds so posts in the same second as the last aren't skipped.
+		lastPosted := posts[len(posts)-1].Posted.UTC().Format(time.RFC3339Nano)
+		feedData["next_url"] = streamurl + "/feed.json?before=" + url.QueryEscape(lastPosted)
+	}
+	return json.Marshal(feedData)
+}
+
 func stream(w http.ResponseWriter, r *http.Request) {
 	before := r.FormValue("before")
 	beforeTime, err := time.Parse(time.RFC3339, before)
@@ -259,7 +613,7 @@ func stream(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("invalid timestamp %s", before), http.StatusBadRequest)
 		return
 	}
-	posts, err := PostsBefore(beforeTime, 20)
+	posts, err := PostsBefore(accountForRequest(r).Id, beforeTime, 20)
 	if err != nil {
 		logr.Errln("Error finding posts older than", before, ":", err.Error())
 		http.Error(w, "error finding posts", http.StatusInternalServerError)
@@ -277,15 +631,17 @@ func stream(w http.ResponseWriter, r *http.Request) {
 }
 
 func index(w http.ResponseWriter, r *http.Request) {
-	posts, err := RecentPosts(20)
+	account := accountForRequest(r)
+	posts, err := RecentPosts(account.Id, 20)
 	if err != nil {
 		logr.Errln("Error loading recent posts for home page:", err.Error())
 	}
 
-	owner := AccountForOwner()
 	data := map[string]interface{}{
-		"posts":     posts,
-		"OwnerName": owner.DisplayName,
+		"posts":      posts,
+		"OwnerName":  account.DisplayName,
+		"streampath": account.Path(),
+		"CsrfToken":  csrfTokenFor(r),
 	}
 	if len(posts) > 0 {
 		data["LastPost"] = posts[len(posts)-1]
@@ -294,20 +650,262 @@ func index(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(html))
 }
 
+func postHistory(w http.ResponseWriter, r *http.Request, post *Post) {
+	revisions, err := RevisionsForPost(post.Id)
+	if err != nil {
+		logr.Errln("Error loading revisions for post", post.Id, ":", err.Error())
+		http.Error(w, "error finding post history", http.StatusInternalServerError)
+		return
+	}
+
+	account, err := post.Account()
+	if err != nil || account == nil {
+		logr.Errln("Error loading account", post.AccountId, "for post", post.Id)
+		http.Error(w, "error finding post history", http.StatusInternalServerError)
+		return
+	}
+	data := map[string]interface{}{
+		"post":       post,
+		"revisions":  revisions,
+		"OwnerName":  account.DisplayName,
+		"streampath": account.Path(),
+	}
+	html := mustache.RenderFile("html/history.html", data)
+	w.Write([]byte(html))
+}
+
+func editPost(w http.ResponseWriter, r *http.Request, post *Post) {
+	if !IsAuthedForPost(w, r, post, "update") {
+		return
+	}
+	if post.Deleted.Valid {
+		http.Error(w, "cannot edit a deleted post", http.StatusConflict)
+		return
+	}
+
+	html := r.FormValue("html")
+	if html == "" {
+		http.Error(w, "html value is required", http.StatusBadRequest)
+		return
+	}
+	html, err := CleanHTML(html)
+	if err != nil {
+		http.Error(w, "error parsing HTML: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if html != post.Html {
+		err = post.Revise(html)
+		if err != nil {
+			http.Error(w, "error saving post to database", http.StatusInternalServerError)
+			logr.Errln("Error saving revision of post", post.Id, ":", err.Error())
+			return
+		}
+
+		err = post.SaveTags(nil)
+		if err != nil {
+			logr.Errln("Error saving tags for revised post", post.Id, ":", err.Error())
+			// but continue
+		}
+
+		if post.Status == POST_PUBLISHED {
+			notifyOfRevision(baseUrlFor(r), post)
+		}
+	}
+
+	ret, err := json.Marshal(post)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
+
+func restorePost(w http.ResponseWriter, r *http.Request, post *Post) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST is required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !IsAuthedForPost(w, r, post, "undelete") {
+		return
+	}
+
+	if post.Deleted.Valid {
+		err := post.Restore()
+		if err != nil {
+			http.Error(w, "error saving post to database", http.StatusInternalServerError)
+			logr.Errln("Error restoring post", post.Id, ":", err.Error())
+			return
+		}
+		// Followers were told it was deleted, so tell them it's back.
+		if post.Status == POST_PUBLISHED {
+			notifyOfPost(baseUrlFor(r), post)
+		}
+	}
+
+	ret, err := json.Marshal(post)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
+
+// postedFromForm parses the requested publication time of a post, if any.
+func postedFromForm(r *http.Request) (posted time.Time, ok bool, err error) {
+	postedStr := r.FormValue("posted")
+	if postedStr == "" {
+		return
+	}
+	posted, err = time.Parse(time.RFC3339, postedStr)
+	ok = err == nil
+	return
+}
+
+func publishPost(w http.ResponseWriter, r *http.Request, post *Post) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST is required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !IsAuthedForPost(w, r, post, "create") {
+		return
+	}
+	if post.Status == POST_PUBLISHED {
+		http.Error(w, "post is already published", http.StatusConflict)
+		return
+	}
+
+	posted, scheduled, err := postedFromForm(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid timestamp %s", r.FormValue("posted")), http.StatusBadRequest)
+		return
+	}
+
+	if scheduled && posted.After(time.Now()) {
+		if !canSchedule(w) {
+			return
+		}
+		post.Posted = posted
+		post.Status = POST_SCHEDULED
+		err = post.Save()
+	} else {
+		post.Posted = time.Now()
+		err = post.Publish()
+	}
+	if err != nil {
+		http.Error(w, "error saving post to database", http.StatusInternalServerError)
+		logr.Errln("Error publishing post", post.Id, ":", err.Error())
+		return
+	}
+	if post.Status == POST_PUBLISHED {
+		notifyOfPost(baseUrlFor(r), post)
+	}
+
+	ret, err := json.Marshal(post)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
+
+func drafts(w http.ResponseWriter, r *http.Request) {
+	account := AccountAuthedFor(w, r, "read")
+	if account == nil {
+		return
+	}
+
+	posts, err := UnpublishedPosts(account.Id)
+	if err != nil {
+		logr.Errln("Error loading unpublished posts for drafts:", err.Error())
+		http.Error(w, "error finding drafts", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"posts":      posts,
+		"OwnerName":  account.DisplayName,
+		"streampath": account.Path(),
+		"CsrfToken":  csrfTokenFor(r),
+	}
+	html := mustache.RenderFile("html/drafts.html", data)
+	w.Write([]byte(html))
+}
+
+func trash(w http.ResponseWriter, r *http.Request) {
+	account := AccountAuthedFor(w, r, "read")
+	if account == nil {
+		return
+	}
+
+	posts, err := DeletedPosts(account.Id)
+	if err != nil {
+		logr.Errln("Error loading deleted posts for trash:", err.Error())
+		http.Error(w, "error finding deleted posts", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"posts":      posts,
+		"OwnerName":  account.DisplayName,
+		"streampath": account.Path(),
+		"CsrfToken":  csrfTokenFor(r),
+	}
+	html := mustache.RenderFile("html/trash.html", data)
+	w.Write([]byte(html))
+}
+
 func permalink(w http.ResponseWriter, r *http.Request) {
-	idstr := r.URL.Path[len("/post/"):]
+	//  /post/<slug>/history
+	// 0 1    2      3
+	pathParts := strings.SplitN(r.URL.Path, "/", 4)
+	idstr := pathParts[2]
 	post, err := PostBySlug(idstr)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("invalid post %s: %s", idstr, err.Error()), http.StatusBadRequest)
 		return
 	}
 
+	// Only the post's account can see drafts and scheduled posts.
+	if post.Status != POST_PUBLISHED && !IsAuthedForPost(w, r, post, "read") {
+		return
+	}
+
+	if len(pathParts) == 4 {
+		if pathParts[3] == "history" {
+			postHistory(w, r, post)
+			return
+		}
+		if pathParts[3] == "restore" {
+			restorePost(w, r, post)
+			return
+		}
+		if pathParts[3] == "publish" {
+			publishPost(w, r, post)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == "PUT" || r.Method == "PATCH" {
+		editPost(w, r, post)
+		return
+	}
 	if r.Method == "DELETE" {
-		if !IsAuthed(w, r) {
+		if !IsAuthedForPost(w, r, post, "delete") {
 			return
 		}
 
 		post.MarkDeleted()
+		if post.Status == POST_PUBLISHED {
+			notifyOfDeletion(baseUrlFor(r), post)
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNoContent)
@@ -315,11 +913,40 @@ func permalink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	owner := AccountForOwner()
+	w.Header().Set("Vary", "Accept")
+	if WantsActivityStreams2(r) {
+		postActivityStream2(w, r, post)
+		return
+	}
+
+	tags, err := post.Tags()
+	if err != nil {
+		logr.Errln("Error loading tags for post", post.Id, ":", err.Error())
+		// but continue
+	}
+
+	mentions, err := WebmentionsForPost(post.Id)
+	if err != nil {
+		logr.Errln("Error loading webmentions for post", post.Id, ":", err.Error())
+		// but continue
+	}
+
+	account, err := post.Account()
+	if err != nil || account == nil {
+		logr.Errln("Error loading account", post.AccountId, "for post", post.Id)
+		http.Error(w, "error finding post", http.StatusInternalServerError)
+		return
+	}
 	data := map[string]interface{}{
-		"post":      post,
-		"OwnerName": owner.DisplayName,
+		"post":        post,
+		"tags":        tags,
+		"mentions":    mentions,
+		"HasMentions": len(mentions) > 0,
+		"OwnerName":   account.DisplayName,
+		"streampath":  account.Path(),
+		"CsrfToken":   csrfTokenFor(r),
 	}
+	w.Header().Add("Link", fmt.Sprintf(`<%s/webmention>; rel="webmention"`, baseUrlFor(r)))
 	html := mustache.RenderFile("html/permalink.html", data)
 	w.Write([]byte(html))
 }
@@ -356,19 +983,80 @@ func CleanHTML(inhtml string) (string, error) {
 	return frag.String(), nil
 }
 
+func notifyFeedSubscribers(baseurl string, account *Account, post *Post) {
+	inBackground(func() { NotifySubscribers(baseurl, account, post) })
+	// rssCloud subscriptions are only for the site owner's feed.
+	if account.IsOwner() {
+		inBackground(func() { NotifyRssCloud(baseurl + "/rss") })
+	}
+}
+
+// accountForNotifying returns the account post belongs to, logging any error
+// finding it.
+func accountForNotifying(post *Post) *Account {
+	account, err := post.Account()
+	if err != nil {
+		logr.Errln("Error loading account", post.AccountId, "to notify about post", post.Id, ":", err.Error())
+		return nil
+	}
+	if account == nil {
+		logr.Errln("No account", post.AccountId, "to notify about post", post.Id)
+	}
+	return account
+}
+
+// notifyOfPost tells the account's realtime subscribers and followers that
+// post is new.
+func notifyOfPost(baseurl string, post *Post) {
+	account := accountForNotifying(post)
+	if account == nil {
+		return
+	}
+	notifyFeedSubscribers(baseurl, account, post)
+	source, html := post.AbsolutePermalink(baseurl), post.Html
+	activity := ActivityForPost(baseurl, post, "Create")
+	inBackground(func() { SendWebmentions(source, html) })
+	inBackground(func() { DeliverToFollowers(account, baseurl, activity) })
+}
+
+// notifyOfRevision tells the account's realtime subscribers and followers
+// that post was changed.
+func notifyOfRevision(baseurl string, post *Post) {
+	account := accountForNotifying(post)
+	if account == nil {
+		return
+	}
+	notifyFeedSubscribers(baseurl, account, post)
+	source, html := post.AbsolutePermalink(baseurl), post.Html
+	activity := ActivityForPost(baseurl, post, "Update")
+	inBackground(func() { SendWebmentions(source, html) })
+	inBackground(func() { DeliverToFollowers(account, baseurl, activity) })
+}
+
+// notifyOfDeletion tells the account's followers that post was deleted.
+func notifyOfDeletion(baseurl string, post *Post) {
+	account := accountForNotifying(post)
+	if account == nil {
+		return
+	}
+	activity := DeleteActivityForPost(baseurl, post)
+	inBackground(func() { DeliverToFollowers(account, baseurl, activity) })
+}
+
 func post(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		w.Header().Set("Allow", "POST")
 		http.Error(w, "POST is required", http.StatusMethodNotAllowed)
 		return
 	}
-	if !IsAuthed(w, r) {
+	account := AccountAuthedFor(w, r, "create")
+	if account == nil {
 		return
 	}
 
 	post := NewPost()
-	// TODO: use the site owner's author id
-	post.AuthorId = 1
+	post.AuthorId = account.AuthorId
+	post.AccountId = account.Id
 
 	html := r.FormValue("html")
 	if html == "" {
@@ -382,26 +1070,41 @@ func post(w http.ResponseWriter, r *http.Request) {
 	}
 	post.Html = html
 
-	err = post.Save()
+	posted, scheduled, err := postedFromForm(r)
 	if err != nil {
-		http.Error(w, "error saving post to database", http.StatusInternalServerError)
-		logr.Errln("Error saving new Post:", err.Error())
+		http.Error(w, fmt.Sprintf("invalid timestamp %s", r.FormValue("posted")), http.StatusBadRequest)
 		return
 	}
+	if r.FormValue("draft") != "" {
+		post.Status = POST_DRAFT
+	} else if scheduled && posted.After(time.Now()) {
+		if !canSchedule(w) {
+			return
+		}
+		post.Status = POST_SCHEDULED
+		post.Posted = posted
+	}
 
-	ws := NewWritestream()
-	ws.PostId = post.Id
-	ws.Posted = post.Posted
-	err = ws.Save()
+	if post.Status == POST_PUBLISHED {
+		err = post.Publish()
+	} else {
+		err = post.Save()
+	}
 	if err != nil {
 		http.Error(w, "error saving post to database", http.StatusInternalServerError)
-		logr.Errln("Error saving Writestream for new post:", err.Error())
+		logr.Errln("Error saving new Post:", err.Error())
 		return
 	}
 
-	// TODO: use proper scheme
-	go NotifyRssCloud(fmt.Sprintf("http://%s/rss", r.Host))
-	go NotifySubscribers(AtomForPosts(r, []*Post{post}, "%s"))
+	err = post.SaveTags(nil)
+	if err != nil {
+		logr.Errln("Error saving tags for new post", post.Id, ":", err.Error())
+		// but continue
+	}
+
+	if post.Status == POST_PUBLISHED {
+		notifyOfPost(baseUrlFor(r), post)
+	}
 
 	ret, err := json.Marshal(post)
 	if err != nil {
@@ -424,10 +1127,87 @@ func indexOr404(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+
+	w.Header().Set("Vary", "Accept")
+	if WantsActivityStreams2(r) {
+		activityStream2(w, r)
+		return
+	}
 	index(w, r)
 }
 
-func ServeWeb(port int) {
+// accountMux serves the streams, feeds and actors of accounts other than the
+// site owner, under /~name/.
+var accountMux = http.NewServeMux()
+
+func init() {
+	accountMux.HandleFunc("/rss", rss)
+	accountMux.HandleFunc("/atom", atom)
+	accountMux.HandleFunc("/activity", activity)
+	accountMux.HandleFunc("/feed.json", jsonFeed)
+	accountMux.HandleFunc("/stream", stream)
+	accountMux.HandleFunc("/archive/", archive)
+	accountMux.HandleFunc("/tag/", tagged)
+	accountMux.HandleFunc("/actor", actor)
+	accountMux.HandleFunc("/inbox", inbox)
+	accountMux.HandleFunc("/outbox", outbox)
+	accountMux.HandleFunc("/followers", followers)
+	accountMux.HandleFunc("/", indexOr404)
+}
+
+func accountStream(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[len("/~"):]
+	rest := ""
+	slash := strings.Index(name, "/")
+	if slash >= 0 {
+		name, rest = name[:slash], name[slash+1:]
+	}
+	if !IsValidAccountName(name) {
+		http.NotFound(w, r)
+		return
+	}
+	if slash < 0 {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	account, err := AccountByName(name)
+	if err != nil {
+		logr.Errln("Error loading account", name, ":", err.Error())
+		http.Error(w, "error finding account", http.StatusInternalServerError)
+		return
+	}
+	if account == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if account.IsOwner() {
+		// The owner's stream is the whole site.
+		http.Redirect(w, r, "/"+rest, http.StatusMovedPermanently)
+		return
+	}
+
+	accountUrl := *r.URL
+	accountUrl.Path = "/" + rest
+	accountUrl.RawPath = ""
+	accountReq := r.WithContext(context.WithValue(r.Context(), accountKey{}, account))
+	accountReq.URL = &accountUrl
+	accountMux.ServeHTTP(w, accountReq)
+}
+
+// root serves the owner's stream at the root of the site, and other accounts'
+// streams under /~name/.
+func root(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/~") {
+		accountStream(w, r)
+		return
+	}
+	indexOr404(w, r)
+}
+
+// ServeWeb serves the site on port. With a TLS certificate and key it serves
+// HTTPS, and also redirects plain HTTP on redirectPort to it if that's set.
+func ServeWeb(port int, certFile, keyFile string, redirectPort int) {
 	err := LoadAccountForOwner()
 	if err != nil {
 		logr.Errln("Error loading site owner:", err.Error())
@@ -441,11 +1221,56 @@ func ServeWeb(port int) {
 	http.HandleFunc("/hub", hub)
 	http.HandleFunc("/post", post)
 	http.HandleFunc("/activity", activity)
+	http.HandleFunc("/feed.json", jsonFeed)
 	http.HandleFunc("/stream", stream)
 	http.HandleFunc("/archive/", archive)
+	http.HandleFunc("/tag/", tagged)
 	http.HandleFunc("/post/", permalink)
-	http.HandleFunc("/", indexOr404)
+	http.HandleFunc("/trash", trash)
+	http.HandleFunc("/actor", actor)
+	http.HandleFunc("/inbox", inbox)
+	http.HandleFunc("/outbox", outbox)
+	http.HandleFunc("/followers", followers)
+	http.HandleFunc("/.well-known/webfinger", webfinger)
+	http.HandleFunc("/webmention", webmention)
+	http.HandleFunc("/micropub", micropub)
+	http.HandleFunc("/drafts", drafts)
+	http.HandleFunc("/login", login)
+	http.HandleFunc("/logout", logout)
+	http.HandleFunc("/audit", audit)
+	http.HandleFunc("/subscribers", subscribers)
+	http.HandleFunc("/auth", authorizationEndpoint)
+	http.HandleFunc("/token", tokenEndpoint)
+	http.HandleFunc("/tokens", tokens)
+	http.HandleFunc("/.well-known/oauth-authorization-server", authorizationServerMetadata)
+	http.HandleFunc("/", root)
+
+	err = LoadSessionSecret()
+	if err != nil {
+		logr.Errln("Error loading session secret:", err.Error())
+		return
+	}
+
+	var servers []*http.Server
+	if certFile == "" {
+		servers = append(servers, &http.Server{Addr: fmt.Sprintf(":%d", port)})
+	} else {
+		reloader, err := NewCertReloader(certFile, keyFile)
+		if err != nil {
+			logr.Errln("Error loading TLS certificate:", err.Error())
+			return
+		}
+		servers = append(servers, newTlsServer(port, reloader))
+		if redirectPort != 0 {
+			servers = append(servers, &http.Server{Addr: fmt.Sprintf(":%d", redirectPort), Handler: redirectToHttps(port)})
+		}
+	}
+
+	stopping := make(chan struct{})
+	inBackground(func() { RunScheduler(stopping) })
+	inBackground(func() { RunDeliveries(stopping) })
+	inBackground(func() { RunSweeper(stopping) })
 
 	logr.Debugln("Ohai web servin'")
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	serveUntilStopped(servers, stopping)
 }
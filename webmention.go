@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/moovweb/gokogiri"
+	"github.com/moovweb/gokogiri/html"
+	"github.com/moovweb/gokogiri/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const MAX_WEBMENTION_FETCH_SIZE = 1 << 20
+
+type Webmention struct {
+	Id       int64
+	PostId   int64
+	Source   string
+	Target   string
+	Title    sql.NullString
+	Verified time.Time
+	Created  time.Time
+}
+
+func NewWebmention() *Webmention {
+	return &Webmention{0, 0, "", "", sql.NullString{"", false}, time.Now().UTC(), time.Now().UTC()}
+}
+
+func (m *Webmention) Save() error {
+	if m.Id == 0 {
+		return db.Insert(m)
+	}
+	_, err := db.Update(m)
+	return err
+}
+
+func (m *Webmention) DisplayTitle() string {
+	if m.Title.Valid && m.Title.String != "" {
+		return m.Title.String
+	}
+	return m.Source
+}
+
+func WebmentionsForPost(postId int64) ([]*Webmention, error) {
+	rows, err := db.Select(Webmention{},
+		"SELECT id, postId, source, target, title, verified, created FROM webmention WHERE postId = $1 ORDER BY created ASC",
+		postId)
+	if err != nil {
+		return nil, err
+	}
+
+	mentions := make([]*Webmention, len(rows))
+	for i, row := range rows {
+		mentions[i] = row.(*Webmention)
+	}
+	return mentions, nil
+}
+
+func WebmentionBySourceTarget(source, target string) (*Webmention, error) {
+	rows, err := db.Select(Webmention{},
+		"SELECT id, postId, source, target, title, verified, created FROM webmention WHERE source = $1 AND target = $2",
+		source, target)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].(*Webmention), nil
+}
+
+func collectLinks(node xml.Node, links []string) []string {
+	for n := node.FirstChild(); n != nil; n = n.NextSibling() {
+		if n.NodeType() != xml.XML_ELEMENT_NODE {
+			continue
+		}
+		if strings.ToLower(n.Name()) == "a" {
+			if href := n.Attr("href"); href != "" {
+				links = append(links, href)
+			}
+		}
+		links = collectLinks(n, links)
+	}
+	return links
+}
+
+// LinksInHtml returns the absolute http and https URLs the given post HTML
+// links to.
+func LinksInHtml(inhtml string) ([]string, error) {
+	frag, err := html.ParseFragment([]byte(inhtml), html.DefaultEncodingBytes, []byte{},
+		html.DefaultParseOption, html.DefaultEncodingBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	links := make([]string, 0)
+	for _, link := range collectLinks(frag, nil) {
+		linkUrl, err := url.Parse(link)
+		if err != nil || (linkUrl.Scheme != "http" && linkUrl.Scheme != "https") {
+			continue
+		}
+		if seen[link] {
+			continue
+		}
+		seen[link] = true
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func fetchForWebmention(fetchUrl string) (*http.Response, []byte, error) {
+	resp, err := outboundClient.Get(fetchUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_WEBMENTION_FETCH_SIZE))
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+var linkHeaderRE = regexp.MustCompile(`^\s*<([^>]*)>(.*)$`)
+
+// webmentionEndpointFromLinkHeaders finds the first link with a rel of
+// webmention in the given Link header values.
+func webmentionEndpointFromLinkHeaders(headers []string) (string, bool) {
+	for _, header := range headers {
+		for _, link := range strings.Split(header, ",") {
+			match := linkHeaderRE.FindStringSubmatch(link)
+			if match == nil {
+				continue
+			}
+			for _, param := range strings.Split(match[2], ";") {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(strings.ToLower(param), "rel=") {
+					continue
+				}
+				rels := strings.Trim(param[len("rel="):], `"`)
+				for _, rel := range strings.Fields(rels) {
+					if strings.ToLower(rel) == "webmention" {
+						return match[1], true
+					}
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+func discoverWebmentionEndpoint(target string) (*url.URL, error) {
+	resp, body, err := fetchForWebmention(target)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("Unexpected response %s fetching %s", resp.Status, target)
+	}
+
+	endpoint, found := webmentionEndpointFromLinkHeaders(resp.Header["Link"])
+	if !found && strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		doc, err := gokogiri.ParseHtml(body)
+		if err != nil {
+			return nil, err
+		}
+		defer doc.Free()
+
+		nodes, err := doc.Root().Search(`//*[self::link or self::a][@href][contains(concat(" ", normalize-space(@rel), " "), " webmention ")]`)
+		if err != nil {
+			return nil, err
+		}
+		if len(nodes) > 0 {
+			endpoint, found = nodes[0].Attr("href"), true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+
+	// Resolve relative to wherever we were redirected to.
+	endpointUrl, err := resp.Request.URL.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return endpointUrl, nil
+}
+
+func sendWebmention(source, target string) {
+	endpoint, err := discoverWebmentionEndpoint(target)
+	if err != nil {
+		logr.Errln("Error discovering webmention endpoint for", target, ":", err.Error())
+		return
+	}
+	if endpoint == nil {
+		logr.Debugln("No webmention endpoint for", target)
+		return
+	}
+
+	form := url.Values{}
+	form.Set("source", source)
+	form.Set("target", target)
+	resp, err := outboundClient.PostForm(endpoint.String(), form)
+	if err != nil {
+		logr.Errln("Error sending webmention for", target, "to", endpoint, ":", err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logr.Errln("Webmention endpoint", endpoint, "rejected mention of", target, "with status", resp.Status)
+		return
+	}
+
+	logr.Debugln("Sent webmention for", target, "to", endpoint)
+}
+
+// SendWebmentions tells the sites source links to that they were mentioned.
+func SendWebmentions(source, html string) {
+	links, err := LinksInHtml(html)
+	if err != nil {
+		logr.Errln("Error finding links to send webmentions for", source, ":", err.Error())
+		return
+	}
+
+	for _, link := range links {
+		link := link
+		inBackground(func() { sendWebmention(source, link) })
+	}
+}
+
+func sourceMentionsTarget(contentType string, body []byte, target string) (bool, string, error) {
+	if !strings.Contains(contentType, "html") {
+		return bytes.Contains(body, []byte(target)), "", nil
+	}
+	// We can't quote a double quote in an XPath string literal.
+	if strings.Contains(target, `"`) {
+		return false, "", nil
+	}
+
+	doc, err := gokogiri.ParseHtml(body)
+	if err != nil {
+		return false, "", err
+	}
+	defer doc.Free()
+
+	nodes, err := doc.Root().Search(fmt.Sprintf(`//*[@href="%s" or @src="%s"]`, target, target))
+	if err != nil {
+		return false, "", err
+	}
+	if len(nodes) == 0 {
+		return false, "", nil
+	}
+
+	title := ""
+	titles, err := doc.Root().Search("//title")
+	if err == nil && len(titles) > 0 {
+		title = strings.TrimSpace(titles[0].Content())
+	}
+	return true, title, nil
+}
+
+func verifyWebmention(source, target string, post *Post) {
+	mention, err := WebmentionBySourceTarget(source, target)
+	if err != nil {
+		logr.Errln("Error looking for existing webmention from", source, ":", err.Error())
+		return
+	}
+
+	resp, body, err := fetchForWebmention(source)
+	if err != nil {
+		logr.Errln("Error fetching webmention source", source, ":", err.Error())
+		return
+	}
+
+	mentioned := false
+	title := ""
+	if resp.StatusCode == http.StatusOK {
+		mentioned, title, err = sourceMentionsTarget(resp.Header.Get("Content-Type"), body, target)
+		if err != nil {
+			logr.Errln("Error parsing webmention source", source, ":", err.Error())
+			return
+		}
+	} else if resp.StatusCode != http.StatusGone {
+		logr.Debugln("Webmention source", source, "responded", resp.Status, "so not verifying")
+		return
+	}
+
+	if !mentioned {
+		logr.Debugln("Webmention source", source, "doesn't link to", target)
+		if mention != nil {
+			_, err = db.Delete(mention)
+			if err != nil {
+				logr.Errln("Error deleting webmention from", source, ":", err.Error())
+			}
+		}
+		return
+	}
+
+	if mention == nil {
+		mention = NewWebmention()
+		mention.PostId = post.Id
+		mention.Source = source
+		mention.Target = target
+	}
+	mention.Title = sql.NullString{title, title != ""}
+	mention.Verified = time.Now().UTC()
+	err = mention.Save()
+	if err != nil {
+		logr.Errln("Error saving webmention from", source, ":", err.Error())
+		return
+	}
+
+	logr.Debugln("Yay, verified webmention from", source, "to", target)
+}
+
+func webmention(w http.ResponseWriter, r *http.Request) {
+	logr.Debugln("Yay, a webmention!")
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST is required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	source, target := r.FormValue("source"), r.FormValue("target")
+	sourceUrl, err := url.Parse(source)
+	if err != nil || (sourceUrl.Scheme != "http" && sourceUrl.Scheme != "https") {
+		http.Error(w, fmt.Sprintf("Source %s is not an http or https URL", source), http.StatusBadRequest)
+		return
+	}
+	targetUrl, err := url.Parse(target)
+	if err != nil || (targetUrl.Scheme != "http" && targetUrl.Scheme != "https") {
+		http.Error(w, fmt.Sprintf("Target %s is not an http or https URL", target), http.StatusBadRequest)
+		return
+	}
+	if source == target {
+		http.Error(w, "Source and target must be different", http.StatusBadRequest)
+		return
+	}
+
+	post, err := PostByPermalink(baseUrlFor(r), target)
+	if err != nil || post == nil || post.Deleted.Valid || post.Status != POST_PUBLISHED {
+		http.Error(w, fmt.Sprintf("Target %s is not a post here", target), http.StatusBadRequest)
+		return
+	}
+
+	inBackground(func() { verifyWebmention(source, target, post) })
+	w.WriteHeader(http.StatusAccepted)
+}